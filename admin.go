@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// deadLetterSummary is the representation of a dead letter returned by the admin API
+type deadLetterSummary struct {
+	ID        uint64    `json:"id"`
+	Repo      string    `json:"repo"`
+	RunID     int64     `json:"run_id"`
+	JobID     int64     `json:"job_id,omitempty"`
+	Name      string    `json:"name"`
+	HTMLURL   string    `json:"html_url"`
+	Attempts  int       `json:"attempts"`
+	LastError string    `json:"last_error"`
+	FailedAt  time.Time `json:"failed_at"`
+}
+
+// registerAdminRoutes adds the admin endpoints to the router, protected by a bearer token
+func (api *API) registerAdminRoutes(token string) {
+	admin := api.Router.Group("/admin", requireBearerToken(token))
+	admin.GET("/deadletters", api.listDeadLetters)
+	admin.POST("/deadletters/:id/redrive", api.redriveDeadLetter)
+}
+
+// requireBearerToken rejects requests that do not carry the given bearer token
+func requireBearerToken(token string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		got, _ := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+		c.Next()
+	}
+}
+
+// listDeadLetters returns the workflow events that could not be traced
+func (api *API) listDeadLetters(c *gin.Context) {
+	dls, err := api.ght.queue.deadLetters()
+	if err != nil {
+		slog.Error("failed to list dead letters", "error", err)
+		c.String(http.StatusInternalServerError, "failed to list dead letters")
+		return
+	}
+	summaries := make([]deadLetterSummary, 0, len(dls))
+	for _, dl := range dls {
+		summary := deadLetterSummary{
+			ID:        dl.ID,
+			Repo:      dl.repo(),
+			RunID:     dl.runID(),
+			Attempts:  dl.Attempts,
+			LastError: dl.LastError,
+			FailedAt:  dl.FailedAt,
+		}
+		if dl.Job != nil {
+			job := dl.Job.GetWorkflowJob()
+			summary.JobID = job.GetID()
+			summary.Name = job.GetName()
+			summary.HTMLURL = job.GetHTMLURL()
+		} else {
+			run := dl.Run.GetWorkflowRun()
+			summary.Name = run.GetName()
+			summary.HTMLURL = run.GetHTMLURL()
+		}
+		summaries = append(summaries, summary)
+	}
+	c.JSON(http.StatusOK, summaries)
+}
+
+// redriveDeadLetter puts a dead-lettered workflow event back onto the work queue
+func (api *API) redriveDeadLetter(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.String(http.StatusBadRequest, "invalid id")
+		return
+	}
+	item, err := api.ght.queue.redrive(id)
+	if errors.Is(err, errDeadLetterNotFound) {
+		c.String(http.StatusNotFound, "dead letter not found")
+		return
+	}
+	if err != nil {
+		slog.Error("failed to redrive dead letter", "id", id, "error", err)
+		c.String(http.StatusInternalServerError, "failed to redrive dead letter")
+		return
+	}
+	slog.Info("redriving dead-lettered workflow event", "id", id, "run_id", item.runID())
+	c.String(http.StatusOK, "ok")
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// attemptKey is the key of a workflow run attempt in the attempts bucket
+func attemptKey(owner, repo string, runID int64, attempt int) []byte {
+	return []byte(fmt.Sprintf("%s/%s/%d/%d", owner, repo, runID, attempt))
+}
+
+// jobKey is the key of a workflow job in the jobs bucket. Jobs are keyed under
+// their run attempt so that they can be cleared once the attempt is traced.
+func jobKey(owner, repo string, runID int64, attempt int, jobID int64) []byte {
+	return append(attemptKey(owner, repo, runID, attempt), []byte(fmt.Sprintf("/%d", jobID))...)
+}
+
+// recordAttempt marks a workflow run attempt as traced so that it is not
+// traced again when a later attempt completes. Records of the attempt's jobs
+// exported from workflow_job events are no longer needed and are removed.
+func (ght *GitHubTracer) recordAttempt(owner, repo string, runID int64, attempt int) error {
+	tracedAt, err := time.Now().MarshalText()
+	if err != nil {
+		return err
+	}
+	key := attemptKey(owner, repo, runID, attempt)
+	return ght.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(attemptsBucket).Put(key, tracedAt); err != nil {
+			return err
+		}
+		prefix := append(key, '/')
+		c := tx.Bucket(jobsBucket).Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Seek(prefix) {
+			if err := c.Delete(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// tracedAttempt reports whether a workflow run attempt has already been traced
+func (ght *GitHubTracer) tracedAttempt(owner, repo string, runID int64, attempt int) (bool, error) {
+	traced := false
+	err := ght.db.View(func(tx *bolt.Tx) error {
+		traced = tx.Bucket(attemptsBucket).Get(attemptKey(owner, repo, runID, attempt)) != nil
+		return nil
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to read traced workflow run attempt: %w", err)
+	}
+	return traced, nil
+}
+
+// recordJob marks a workflow job as exported, from its workflow_job event or
+// while tracing its run attempt, so that it is skipped when the run attempt is
+// traced or retried
+func (ght *GitHubTracer) recordJob(owner, repo string, runID int64, attempt int, jobID int64) error {
+	tracedAt, err := time.Now().MarshalText()
+	if err != nil {
+		return err
+	}
+	return ght.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(jobsBucket).Put(jobKey(owner, repo, runID, attempt, jobID), tracedAt)
+	})
+}
+
+// exportedJob reports whether a workflow job was already exported
+func (ght *GitHubTracer) exportedJob(owner, repo string, runID int64, attempt int, jobID int64) (bool, error) {
+	exported := false
+	err := ght.db.View(func(tx *bolt.Tx) error {
+		exported = tx.Bucket(jobsBucket).Get(jobKey(owner, repo, runID, attempt, jobID)) != nil
+		return nil
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to read exported workflow job: %w", err)
+	}
+	return exported, nil
+}
+
+// sweep periodically removes the records of run attempts traced longer than
+// the retention ago, so that the store does not grow forever. Records of jobs
+// and the run traces resolved for them are removed once their run attempt is
+// traced, so they are only expired here if the run never completes.
+func (ght *GitHubTracer) sweep() {
+	ticker := time.NewTicker(sweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ght.quit:
+			return
+		case <-ticker.C:
+		}
+		cutoff := time.Now().Add(-ght.retention)
+		removed, err := sweepBucket(ght.db, attemptsBucket, cutoff)
+		if err != nil {
+			slog.Error("failed to remove expired workflow run attempts", "error", err)
+			continue
+		}
+		if removed > 0 {
+			slog.Debug("removed expired workflow run attempts", "count", removed)
+		}
+		removed, err = sweepBucket(ght.db, jobsBucket, cutoff)
+		if err != nil {
+			slog.Error("failed to remove expired workflow jobs", "error", err)
+			continue
+		}
+		if removed > 0 {
+			slog.Debug("removed expired workflow jobs", "count", removed)
+		}
+		ght.runTraces.Range(func(key, entry any) bool {
+			if entry.(runTraceEntry).resolvedAt.Before(cutoff) {
+				ght.runTraces.Delete(key)
+			}
+			return true
+		})
+	}
+}
+
+// sweepBucket removes the entries of a bucket recorded before cutoff. Entries
+// hold the time they were recorded at, entries that do not are removed too.
+func sweepBucket(db *bolt.DB, bucket []byte, cutoff time.Time) (int, error) {
+	var expired [][]byte
+	err := db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucket)
+		err := b.ForEach(func(k, v []byte) error {
+			var recordedAt time.Time
+			if err := recordedAt.UnmarshalText(v); err == nil && !recordedAt.Before(cutoff) {
+				return nil
+			}
+			expired = append(expired, bytes.Clone(k))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range expired {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return len(expired), err
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/google/go-github/v58/github"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// attributeMode selects which attribute keys are emitted on spans
+type attributeMode string
+
+const (
+	// attributeModeLegacy emits the original github.* keys
+	attributeModeLegacy attributeMode = "legacy"
+	// attributeModeSemconv emits the OpenTelemetry CI/CD and VCS semantic convention keys
+	attributeModeSemconv attributeMode = "semconv"
+	// attributeModeBoth emits both sets of keys, to ease migrating dashboards
+	attributeModeBoth attributeMode = "both"
+)
+
+// parseAttributeMode validates an attribute mode from the configuration
+func parseAttributeMode(mode string) (attributeMode, error) {
+	switch m := attributeMode(mode); m {
+	case attributeModeLegacy, attributeModeSemconv, attributeModeBoth:
+		return m, nil
+	}
+	return "", fmt.Errorf("invalid attribute mode %q, must be one of legacy, semconv or both", mode)
+}
+
+// runSpanKind is the kind of a run's root span. The semantic conventions
+// model a pipeline run as a server span.
+func (m attributeMode) runSpanKind() trace.SpanKind {
+	if m == attributeModeLegacy {
+		return trace.SpanKindInternal
+	}
+	return trace.SpanKindServer
+}
+
+// attrs accumulates span attributes. GitHub omits many fields depending on the
+// state of a run, job or step, so values are only added when they are present.
+//
+// Each value is given a legacy github.* key and a semantic convention key and
+// the attribute mode selects which are emitted. Values the conventions have no
+// key for keep their github.* key in every mode, while values that only have a
+// semantic convention key are left out in legacy mode.
+type attrs struct {
+	mode attributeMode
+	kvs  []attribute.KeyValue
+}
+
+// keys returns the keys a value is emitted under
+func (a *attrs) keys(legacy, semconv string) []string {
+	var keys []string
+	if legacy != "" && (a.mode != attributeModeSemconv || semconv == "") {
+		keys = append(keys, legacy)
+	}
+	if semconv != "" && a.mode != attributeModeLegacy {
+		keys = append(keys, semconv)
+	}
+	return keys
+}
+
+func (a *attrs) str(legacy, semconv string, v *string) {
+	if v != nil {
+		for _, key := range a.keys(legacy, semconv) {
+			a.kvs = append(a.kvs, attribute.String(key, *v))
+		}
+	}
+}
+
+func (a *attrs) int(legacy, semconv string, v *int) {
+	if v != nil {
+		for _, key := range a.keys(legacy, semconv) {
+			a.kvs = append(a.kvs, attribute.Int(key, *v))
+		}
+	}
+}
+
+func (a *attrs) int64(legacy, semconv string, v *int64) {
+	if v != nil {
+		for _, key := range a.keys(legacy, semconv) {
+			a.kvs = append(a.kvs, attribute.Int64(key, *v))
+		}
+	}
+}
+
+func (a *attrs) time(legacy, semconv string, v *github.Timestamp) {
+	if v != nil {
+		for _, key := range a.keys(legacy, semconv) {
+			a.kvs = append(a.kvs, attribute.String(key, v.String()))
+		}
+	}
+}
+
+func (a *attrs) bool(legacy, semconv string, v bool) {
+	for _, key := range a.keys(legacy, semconv) {
+		a.kvs = append(a.kvs, attribute.Bool(key, v))
+	}
+}
+
+func (a *attrs) strs(legacy, semconv string, v []string) {
+	if len(v) > 0 {
+		for _, key := range a.keys(legacy, semconv) {
+			a.kvs = append(a.kvs, attribute.StringSlice(key, v))
+		}
+	}
+}
+
+// result adds the normalized result of a conclusion
+func (a *attrs) result(key string, conclusion *string) {
+	if result := conclusionResult(conclusion); result != "" {
+		a.str("", key, &result)
+	}
+}
+
+// runAttributes maps a workflow run onto the attributes of its root span
+func runAttributes(owner, repo string, run *github.WorkflowRun, mode attributeMode) []attribute.KeyValue {
+	a := &attrs{mode: mode}
+	a.str("github.owner", "vcs.owner.name", &owner)
+	a.str("github.repo", "vcs.repository.name", &repo)
+	a.str("", "vcs.provider.name", github.String("github"))
+	a.str("", "vcs.repository.url.full", run.GetRepository().HTMLURL)
+	a.int64("github.workflow_id", "", run.WorkflowID)
+	a.str("", "cicd.pipeline.name", run.Name)
+	a.int64("github.run_id", "cicd.pipeline.run.id", run.ID)
+	a.int("github.run_number", "", run.RunNumber)
+	a.int("github.run_attempt", "", run.RunAttempt)
+	a.str("github.html_url", "cicd.pipeline.run.url.full", run.HTMLURL)
+	a.time("github.created_at", "", run.CreatedAt)
+	a.time("github.run_started_at", "", run.RunStartedAt)
+	a.time("github.updated_at", "", run.UpdatedAt)
+	a.str("github.event", "", run.Event)
+	a.str("github.status", "", run.Status)
+	a.str("github.conclusion", "", run.Conclusion)
+	a.result("cicd.pipeline.result", run.Conclusion)
+	a.str("github.head_branch", "vcs.ref.head.name", run.HeadBranch)
+	a.str("github.head_sha", "vcs.ref.head.revision", run.HeadSHA)
+
+	// Add pull request attributes if this is a workflow triggered from a pull request.
+	// Pull requests from forks do not include all of their fields.
+	if len(run.PullRequests) > 0 && run.PullRequests[0] != nil {
+		pr := run.PullRequests[0]
+		if pr.Head != nil {
+			a.str("github.head_ref", "", pr.Head.Ref)
+		}
+		if pr.Base != nil {
+			a.str("github.base_ref", "vcs.ref.base.name", pr.Base.Ref)
+			a.str("github.base_sha", "vcs.ref.base.revision", pr.Base.SHA)
+		}
+		a.str("github.pull_request.url", "", pr.URL)
+		if pr.Number != nil {
+			a.str("", "vcs.change.id", github.String(strconv.Itoa(*pr.Number)))
+		}
+	}
+	return a.kvs
+}
+
+// jobAttributes maps a workflow job onto the attributes of its span
+func jobAttributes(job *github.WorkflowJob, reexecuted bool, mode attributeMode) []attribute.KeyValue {
+	a := &attrs{mode: mode}
+	a.int64("github.job.id", "cicd.pipeline.task.run.id", job.ID)
+	a.int64("github.job.run_id", "cicd.pipeline.run.id", job.RunID)
+	a.str("github.job.name", "cicd.pipeline.task.name", job.Name)
+	a.str("github.job.status", "", job.Status)
+	a.str("github.job.conclusion", "", job.Conclusion)
+	a.result("cicd.pipeline.task.run.result", job.Conclusion)
+	a.str("github.job.html_url", "cicd.pipeline.task.run.url.full", job.HTMLURL)
+	a.time("github.job.started_at", "", job.StartedAt)
+	a.time("github.job.completed_at", "", job.CompletedAt)
+	a.strs("github.job.runs_on", "", job.Labels)
+	a.bool("github.job.reexecuted", "", reexecuted)
+
+	// Add runner attributes if available
+	a.int64("github.job.runner_id", "cicd.worker.id", job.RunnerID)
+	a.int64("github.job.runner_group_id", "", job.RunnerGroupID)
+	a.str("github.job.runner_group_name", "", job.RunnerGroupName)
+	a.str("github.job.runner_name", "cicd.worker.name", job.RunnerName)
+	return a.kvs
+}
+
+// queueAttributes describes the runner a workflow job requested and the runner
+// group it was eventually assigned to
+func queueAttributes(job *github.WorkflowJob, mode attributeMode) []attribute.KeyValue {
+	a := &attrs{mode: mode}
+	a.strs("github.job.runs_on", "", job.Labels)
+	a.int64("github.job.runner_group_id", "", job.RunnerGroupID)
+	a.str("github.job.runner_group_name", "", job.RunnerGroupName)
+	return a.kvs
+}
+
+// stepAttributes maps a workflow step onto the attributes of its span. The
+// semantic conventions model jobs as tasks and have nothing below them, so
+// steps keep their github.step.* keys in every mode.
+func stepAttributes(step *github.TaskStep) []attribute.KeyValue {
+	a := &attrs{mode: attributeModeLegacy}
+	a.str("github.step.name", "", step.Name)
+	a.str("github.step.status", "", step.Status)
+	a.str("github.step.conclusion", "", step.Conclusion)
+	a.time("github.step.started_at", "", step.StartedAt)
+	a.time("github.step.completed_at", "", step.CompletedAt)
+	a.int64("github.step.number", "", step.Number)
+	return a.kvs
+}
+
+// firstTime returns the first of the given timestamps that is set, or fallback
+func firstTime(fallback time.Time, ts ...*github.Timestamp) time.Time {
+	for _, t := range ts {
+		if t != nil && !t.IsZero() {
+			return t.Time
+		}
+	}
+	return fallback
+}
+
+// spanTimes returns the start and end of a span, making sure it does not end
+// before it starts
+func spanTimes(start, end time.Time) (time.Time, time.Time) {
+	if end.Before(start) {
+		end = start
+	}
+	return start, end
+}
+
+// runTimes returns the start and end of a workflow run's root span
+func runTimes(run *github.WorkflowRun) (time.Time, time.Time) {
+	start := firstTime(time.Now(), run.CreatedAt, run.RunStartedAt, run.UpdatedAt)
+	return spanTimes(start, firstTime(start, run.UpdatedAt))
+}
+
+// jobTimes returns the start and end of a workflow job's span. Jobs that never
+// started, such as skipped jobs, fall back to their creation time.
+func jobTimes(job *github.WorkflowJob, fallback time.Time) (time.Time, time.Time) {
+	start := firstTime(fallback, job.StartedAt, job.CreatedAt, job.CompletedAt)
+	return spanTimes(start, firstTime(start, job.CompletedAt))
+}
+
+// groupTimes returns the start and end of a span grouping workflow jobs, from
+// the creation of the first job to the completion of the last
+func groupTimes(jobs []*github.WorkflowJob) (time.Time, time.Time) {
+	var start, end time.Time
+	for _, job := range jobs {
+		jobStart, jobEnd := jobTimes(job, time.Now())
+		jobStart = firstTime(jobStart, job.CreatedAt)
+		if start.IsZero() || jobStart.Before(start) {
+			start = jobStart
+		}
+		if jobEnd.After(end) {
+			end = jobEnd
+		}
+	}
+	return spanTimes(start, end)
+}
+
+// stepTimes returns the start and end of a workflow step's span. Steps that
+// never started, for example because an earlier step failed, are placed at
+// fallback, the end of the previous step.
+func stepTimes(step *github.TaskStep, fallback time.Time) (time.Time, time.Time) {
+	start := firstTime(fallback, step.StartedAt, step.CompletedAt)
+	return spanTimes(start, firstTime(start, step.CompletedAt))
+}
+
+// stepTime is the start and end of a workflow step's span
+type stepTime struct {
+	step       *github.TaskStep
+	start, end time.Time
+}
+
+// jobStepTimes returns the start and end of the spans of a workflow job's
+// steps. Steps that never started are placed at the end of the step before
+// them, or at jobStart for the first step.
+func jobStepTimes(job *github.WorkflowJob, jobStart time.Time) []stepTime {
+	var times []stepTime
+	previousEnd := jobStart
+	for _, step := range job.Steps {
+		if step == nil {
+			continue
+		}
+		start, end := stepTimes(step, previousEnd)
+		times = append(times, stepTime{step: step, start: start, end: end})
+		previousEnd = end
+	}
+	return times
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestAttrsKeys(t *testing.T) {
+	tests := []struct {
+		name    string
+		mode    attributeMode
+		legacy  string
+		semconv string
+		want    []string
+	}{
+		{"legacy with both keys", attributeModeLegacy, "github.run_id", "cicd.pipeline.run.id", []string{"github.run_id"}},
+		{"semconv with both keys", attributeModeSemconv, "github.run_id", "cicd.pipeline.run.id", []string{"cicd.pipeline.run.id"}},
+		{"both with both keys", attributeModeBoth, "github.run_id", "cicd.pipeline.run.id", []string{"github.run_id", "cicd.pipeline.run.id"}},
+		{"legacy only key in legacy", attributeModeLegacy, "github.run_attempt", "", []string{"github.run_attempt"}},
+		{"legacy only key in semconv", attributeModeSemconv, "github.run_attempt", "", []string{"github.run_attempt"}},
+		{"legacy only key in both", attributeModeBoth, "github.run_attempt", "", []string{"github.run_attempt"}},
+		{"semconv only key in legacy", attributeModeLegacy, "", "vcs.provider.name", nil},
+		{"semconv only key in semconv", attributeModeSemconv, "", "vcs.provider.name", []string{"vcs.provider.name"}},
+		{"semconv only key in both", attributeModeBoth, "", "vcs.provider.name", []string{"vcs.provider.name"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := &attrs{mode: tt.mode}
+			if got := a.keys(tt.legacy, tt.semconv); !slices.Equal(got, tt.want) {
+				t.Errorf("keys() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/go-github/v58/github"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// Dimensions that CI metrics can be broken down by. Only the dimensions in the
+// allowlist are recorded, to keep the cardinality of the metrics under control.
+const (
+	dimensionRepository   = "repository"
+	dimensionWorkflow     = "workflow"
+	dimensionBranch       = "branch"
+	dimensionEvent        = "event"
+	dimensionJob          = "job"
+	dimensionStep         = "step"
+	dimensionRunnerLabels = "runner_labels"
+	dimensionRunnerGroup  = "runner_group"
+	dimensionConclusion   = "conclusion"
+)
+
+// dimensionKeys maps each dimension onto its attribute key
+var dimensionKeys = map[string]attribute.Key{
+	dimensionRepository:   "github.repository",
+	dimensionWorkflow:     "github.workflow",
+	dimensionBranch:       "github.head_branch",
+	dimensionEvent:        "github.event",
+	dimensionJob:          "github.job.name",
+	dimensionStep:         "github.step.name",
+	dimensionRunnerLabels: "github.job.runs_on",
+	dimensionRunnerGroup:  "github.job.runner_group_name",
+	dimensionConclusion:   "github.conclusion",
+}
+
+// ciMetrics records the duration and outcome of workflow runs, jobs and steps
+type ciMetrics struct {
+	dimensions    []string
+	runDuration   metric.Float64Histogram
+	jobDuration   metric.Float64Histogram
+	stepDuration  metric.Float64Histogram
+	queueDuration metric.Float64Histogram
+	runs          metric.Int64Counter
+	jobs          metric.Int64Counter
+}
+
+// newCIMetrics creates the CI instruments, recording only the given dimensions
+func newCIMetrics(meter metric.Meter, dimensions []string) (*ciMetrics, error) {
+	m := &ciMetrics{}
+	for _, dimension := range dimensions {
+		if dimension == "" {
+			continue
+		}
+		if _, ok := dimensionKeys[dimension]; !ok {
+			return nil, fmt.Errorf("invalid metric dimension %q", dimension)
+		}
+		m.dimensions = append(m.dimensions, dimension)
+	}
+
+	var err error
+	if m.runDuration, err = meter.Float64Histogram("github.actions.run.duration",
+		metric.WithUnit("s"),
+		metric.WithDescription("Duration of workflow runs, from creation to completion.")); err != nil {
+		return nil, err
+	}
+	if m.jobDuration, err = meter.Float64Histogram("github.actions.job.duration",
+		metric.WithUnit("s"),
+		metric.WithDescription("Duration of workflow jobs, from starting on a runner to completion.")); err != nil {
+		return nil, err
+	}
+	if m.stepDuration, err = meter.Float64Histogram("github.actions.step.duration",
+		metric.WithUnit("s"),
+		metric.WithDescription("Duration of workflow steps.")); err != nil {
+		return nil, err
+	}
+	if m.queueDuration, err = meter.Float64Histogram("github.actions.job.queue.duration",
+		metric.WithUnit("s"),
+		metric.WithDescription("Time workflow jobs waited for a runner.")); err != nil {
+		return nil, err
+	}
+	if m.runs, err = meter.Int64Counter("github.actions.runs",
+		metric.WithUnit("{run}"),
+		metric.WithDescription("Number of completed workflow runs.")); err != nil {
+		return nil, err
+	}
+	if m.jobs, err = meter.Int64Counter("github.actions.jobs",
+		metric.WithUnit("{job}"),
+		metric.WithDescription("Number of completed workflow jobs.")); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// attributes returns the allowed dimensions out of values as measurement attributes
+func (m *ciMetrics) attributes(values map[string]string) metric.MeasurementOption {
+	kvs := make([]attribute.KeyValue, 0, len(m.dimensions))
+	for _, dimension := range m.dimensions {
+		if v, ok := values[dimension]; ok {
+			kvs = append(kvs, dimensionKeys[dimension].String(v))
+		}
+	}
+	return metric.WithAttributes(kvs...)
+}
+
+// recordRun records the duration and outcome of a workflow run attempt
+func (m *ciMetrics) recordRun(owner, repo string, run *github.WorkflowRun) {
+	ctx := context.Background()
+	values := map[string]string{
+		dimensionRepository: owner + "/" + repo,
+		dimensionWorkflow:   run.GetName(),
+		dimensionBranch:     run.GetHeadBranch(),
+		dimensionEvent:      run.GetEvent(),
+		dimensionConclusion: run.GetConclusion(),
+	}
+	attrs := m.attributes(values)
+	start, end := runTimes(run)
+	m.runDuration.Record(ctx, end.Sub(start).Seconds(), attrs)
+	m.runs.Add(ctx, 1, attrs)
+}
+
+// recordJob records the duration and outcome of a workflow job, along with the
+// time it waited for a runner and the duration of its steps. The event that
+// triggered the run is empty if it is not known.
+func (m *ciMetrics) recordJob(owner, repo, event string, job *github.WorkflowJob) {
+	ctx := context.Background()
+	labels := slices.Clone(job.Labels)
+	slices.Sort(labels)
+	values := map[string]string{
+		dimensionRepository:   owner + "/" + repo,
+		dimensionWorkflow:     job.GetWorkflowName(),
+		dimensionBranch:       job.GetHeadBranch(),
+		dimensionJob:          job.GetName(),
+		dimensionRunnerLabels: strings.Join(labels, ","),
+		dimensionRunnerGroup:  job.GetRunnerGroupName(),
+		dimensionConclusion:   job.GetConclusion(),
+	}
+	if event != "" {
+		values[dimensionEvent] = event
+	}
+	attrs := m.attributes(values)
+	m.jobs.Add(ctx, 1, attrs)
+	// Jobs that never started have no duration
+	if job.StartedAt == nil {
+		return
+	}
+	start, end := jobTimes(job, time.Now())
+	m.jobDuration.Record(ctx, end.Sub(start).Seconds(), attrs)
+	if job.CreatedAt != nil {
+		m.queueDuration.Record(ctx, start.Sub(job.CreatedAt.Time).Seconds(), attrs)
+	}
+	for _, st := range jobStepTimes(job, start) {
+		if st.step.StartedAt == nil {
+			continue
+		}
+		values[dimensionStep] = st.step.GetName()
+		values[dimensionConclusion] = st.step.GetConclusion()
+		m.stepDuration.Record(ctx, st.end.Sub(st.start).Seconds(), m.attributes(values))
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/google/go-github/v58/github"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Normalized results of a run, job or step, following the values of the
+// OpenTelemetry cicd.pipeline.result attribute
+const (
+	resultSuccess      = "success"
+	resultFailure      = "failure"
+	resultError        = "error"
+	resultTimeout      = "timeout"
+	resultCancellation = "cancellation"
+	resultSkip         = "skip"
+)
+
+// outcome is how a GitHub conclusion is reported on a span
+type outcome struct {
+	result string
+	code   codes.Code
+}
+
+// outcomes maps every conclusion GitHub reports for runs, jobs and steps.
+// Only conclusions where the work itself went wrong are errors, runs that were
+// cancelled, skipped or are waiting for approval leave the status unset.
+var outcomes = map[string]outcome{
+	"success":         {resultSuccess, codes.Ok},
+	"neutral":         {resultSuccess, codes.Unset},
+	"failure":         {resultFailure, codes.Error},
+	"timed_out":       {resultTimeout, codes.Error},
+	"startup_failure": {resultError, codes.Error},
+	"cancelled":       {resultCancellation, codes.Unset},
+	"skipped":         {resultSkip, codes.Unset},
+	"stale":           {resultSkip, codes.Unset},
+	"action_required": {resultSkip, codes.Unset},
+}
+
+// conclusionResult returns the normalized result of a conclusion, or an empty
+// string if the conclusion is missing or unknown
+func conclusionResult(conclusion *string) string {
+	if conclusion == nil {
+		return ""
+	}
+	return outcomes[*conclusion].result
+}
+
+// setConclusionStatus sets the status of a span from a GitHub conclusion. The
+// description is only used for error statuses.
+func setConclusionStatus(span trace.Span, conclusion *string, description string) {
+	if conclusion == nil {
+		return
+	}
+	o, ok := outcomes[*conclusion]
+	if !ok {
+		slog.Debug("unknown conclusion", "conclusion", *conclusion)
+		return
+	}
+	switch o.code {
+	case codes.Error:
+		span.SetStatus(codes.Error, description)
+	case codes.Ok:
+		span.SetStatus(codes.Ok, "")
+	}
+}
+
+// failed reports whether a conclusion is reported as an error
+func failed(conclusion *string) bool {
+	return conclusion != nil && outcomes[*conclusion].code == codes.Error
+}
+
+// countFailed returns the number of workflow jobs whose conclusion is reported as an error
+func countFailed(jobs []*github.WorkflowJob) int {
+	n := 0
+	for _, job := range jobs {
+		if failed(job.Conclusion) {
+			n++
+		}
+	}
+	return n
+}
+
+// conclusionDescription returns a default error description for a conclusion
+func conclusionDescription(kind, conclusion string) string {
+	switch outcomes[conclusion].result {
+	case resultTimeout:
+		return fmt.Sprintf("workflow %s timed out", kind)
+	case resultError:
+		return fmt.Sprintf("workflow %s failed to start", kind)
+	}
+	return fmt.Sprintf("workflow %s failed", kind)
+}
+
+// jobErrorDescription returns the message of the first failure annotation of
+// a job, falling back to a description of its conclusion. A job's ID is also
+// the ID of the check run that holds its annotations.
+func (ght *GitHubTracer) jobErrorDescription(ctx context.Context, owner, repo string, job *github.WorkflowJob) string {
+	annotations, _, err := ght.ghclient.Checks.ListCheckRunAnnotations(ctx, owner, repo, job.GetID(), nil)
+	if err != nil {
+		slog.Debug("failed to retrieve workflow job annotations", "job_id", job.GetID(), "error", err)
+	}
+	for _, annotation := range annotations {
+		if annotation.GetAnnotationLevel() == "failure" && annotation.GetMessage() != "" {
+			return strings.TrimSpace(annotation.GetMessage())
+		}
+	}
+	return conclusionDescription("job", job.GetConclusion())
+}
+
+// runErrorDescription describes a failed run by the jobs that failed in it
+func runErrorDescription(run *github.WorkflowRun, failedJobs []string) string {
+	if len(failedJobs) == 0 {
+		return conclusionDescription("run", run.GetConclusion())
+	}
+	return fmt.Sprintf("%s: %s", conclusionDescription("run", run.GetConclusion()), strings.Join(failedJobs, ", "))
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/go-github/v58/github"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestConclusionOutcomes(t *testing.T) {
+	tests := []struct {
+		conclusion *string
+		wantResult string
+		wantCode   codes.Code
+		wantFailed bool
+	}{
+		{github.String("success"), resultSuccess, codes.Ok, false},
+		{github.String("neutral"), resultSuccess, codes.Unset, false},
+		{github.String("failure"), resultFailure, codes.Error, true},
+		{github.String("timed_out"), resultTimeout, codes.Error, true},
+		{github.String("startup_failure"), resultError, codes.Error, true},
+		{github.String("cancelled"), resultCancellation, codes.Unset, false},
+		{github.String("skipped"), resultSkip, codes.Unset, false},
+		{github.String("stale"), resultSkip, codes.Unset, false},
+		{github.String("action_required"), resultSkip, codes.Unset, false},
+		{github.String("unknown"), "", codes.Unset, false},
+		{nil, "", codes.Unset, false},
+	}
+	for _, tt := range tests {
+		name := "<nil>"
+		if tt.conclusion != nil {
+			name = *tt.conclusion
+		}
+		t.Run(name, func(t *testing.T) {
+			if got := conclusionResult(tt.conclusion); got != tt.wantResult {
+				t.Errorf("conclusionResult() = %q, want %q", got, tt.wantResult)
+			}
+			if got := failed(tt.conclusion); got != tt.wantFailed {
+				t.Errorf("failed() = %v, want %v", got, tt.wantFailed)
+			}
+
+			recorder := tracetest.NewSpanRecorder()
+			tp := trace.NewTracerProvider(trace.WithSpanProcessor(recorder))
+			_, span := tp.Tracer("test").Start(context.Background(), "job")
+			setConclusionStatus(span, tt.conclusion, "job failed")
+			span.End()
+			status := recorder.Ended()[0].Status()
+			if status.Code != tt.wantCode {
+				t.Errorf("status code = %v, want %v", status.Code, tt.wantCode)
+			}
+			if tt.wantCode == codes.Error && status.Description != "job failed" {
+				t.Errorf("status description = %q, want %q", status.Description, "job failed")
+			}
+		})
+	}
+}
+
+func TestConclusionDescription(t *testing.T) {
+	tests := []struct {
+		conclusion string
+		want       string
+	}{
+		{"failure", "workflow job failed"},
+		{"timed_out", "workflow job timed out"},
+		{"startup_failure", "workflow job failed to start"},
+		{"unknown", "workflow job failed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.conclusion, func(t *testing.T) {
+			if got := conclusionDescription("job", tt.conclusion); got != tt.want {
+				t.Errorf("conclusionDescription() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// errDeadLetterNotFound is returned when redriving an unknown dead letter
+var errDeadLetterNotFound = errors.New("dead letter not found")
+
+// deadLetter is a queue item that could not be processed. It keeps the
+// original event along with the last error and attempt count.
+type deadLetter struct {
+	queueItem
+	FailedAt time.Time `json:"failed_at"`
+}
+
+// bury moves an item that can no longer be retried from the queue to the
+// dead letter store.
+func (q *workQueue) bury(item *queueItem) error {
+	dl := deadLetter{
+		queueItem: *item,
+		FailedAt:  time.Now(),
+	}
+	dl.NotBefore = time.Time{}
+	buf, err := json.Marshal(dl)
+	if err != nil {
+		return fmt.Errorf("failed to encode dead letter: %w", err)
+	}
+	err = q.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(queueBucket).Delete(itob(item.ID)); err != nil {
+			return err
+		}
+		return tx.Bucket(deadLetterBucket).Put(itob(item.ID), buf)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to persist dead letter: %w", err)
+	}
+	return nil
+}
+
+// deadLetters returns all dead-lettered items, oldest first
+func (q *workQueue) deadLetters() ([]deadLetter, error) {
+	dls := []deadLetter{}
+	err := q.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(deadLetterBucket).ForEach(func(k, v []byte) error {
+			var dl deadLetter
+			if err := json.Unmarshal(v, &dl); err != nil {
+				return fmt.Errorf("failed to decode dead letter: %w", err)
+			}
+			dls = append(dls, dl)
+			return nil
+		})
+	})
+	return dls, err
+}
+
+// redrive moves a dead-lettered item back onto the queue with its
+// attempts reset.
+func (q *workQueue) redrive(id uint64) (*queueItem, error) {
+	var item *queueItem
+	err := q.db.Update(func(tx *bolt.Tx) error {
+		dlb := tx.Bucket(deadLetterBucket)
+		v := dlb.Get(itob(id))
+		if v == nil {
+			return errDeadLetterNotFound
+		}
+		var dl deadLetter
+		if err := json.Unmarshal(v, &dl); err != nil {
+			return fmt.Errorf("failed to decode dead letter: %w", err)
+		}
+		item = &dl.queueItem
+		item.Attempts = 0
+		item.LastError = ""
+		item.EnqueuedAt = time.Now()
+		buf, err := json.Marshal(item)
+		if err != nil {
+			return err
+		}
+		if err := dlb.Delete(itob(id)); err != nil {
+			return err
+		}
+		return tx.Bucket(queueBucket).Put(itob(id), buf)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	q.mu.Lock()
+	q.enqueue(item)
+	q.mu.Unlock()
+	q.signal()
+	return item, nil
+}
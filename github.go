@@ -1,21 +1,26 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"fmt"
+	"io"
 	"log/slog"
+	"maps"
 	"net/http"
+	"runtime/debug"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/bradleyfalzon/ghinstallation/v2"
 	"github.com/google/go-github/v58/github"
-	"github.com/grafana/loki-client-go/loki"
-	"github.com/prometheus/common/model"
+	bolt "go.etcd.io/bbolt"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/codes"
+	otellog "go.opentelemetry.io/otel/log"
+	"go.opentelemetry.io/otel/propagation"
 	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/oauth2"
 )
@@ -40,6 +45,7 @@ func getGithubClient(ghapat, appFilename string, appID int64, installID int64) (
 			&oauth2.Token{AccessToken: ghapat},
 		)
 		tc := oauth2.NewClient(context.Background(), ts)
+		tc.Transport = &instrumentedTransport{base: tc.Transport}
 		return github.NewClient(tc), nil
 	}
 	// If a GitHub App file path is provided, use that for authentication
@@ -48,169 +54,625 @@ func getGithubClient(ghapat, appFilename string, appID int64, installID int64) (
 	if err != nil {
 		return nil, fmt.Errorf("failed to create github app installation transport: %w", err)
 	}
-	client := github.NewClient(&http.Client{Transport: itr})
+	client := github.NewClient(&http.Client{Transport: &instrumentedTransport{base: itr}})
 	return client, nil
 }
 
 // GitHubTracer is a struct that implements the Tracer interface
 // to emit telemetry for GitHub Actions workflows
 type GitHubTracer struct {
-	ctx        context.Context
-	ghclient   *github.Client
-	lokiClient *loki.Client
-	quit       chan struct{}
-	queue      chan github.WorkflowRunEvent
+	ctx         context.Context
+	ghclient    *github.Client
+	loki        *lokiPusher
+	db          *bolt.DB
+	quit        chan struct{}
+	done        chan struct{}
+	queue       *workQueue
+	retry       retryPolicy
+	attrMode    attributeMode
+	triggerMode triggerMode
+	// metrics records the duration and outcome of runs, jobs and steps
+	metrics *ciMetrics
+	// logger exports job logs as OTLP log records, if enabled
+	logger otellog.Logger
+	// logMaxBytes is the size at which job logs are truncated, 0 for no limit
+	logMaxBytes int64
+	// flush exports the buffered spans and log records, so that an event is
+	// only removed from the queue once its telemetry has left the process
+	flush func(context.Context) error
+	// retention is how long the records of traced run attempts are kept, and
+	// the records of jobs of run attempts that never complete
+	retention time.Duration
+	// receiver buffers the spans sent by workflow steps, if enabled
+	receiver *spanReceiver
+	// workflowPaths caches the file paths of workflows
+	workflowPaths sync.Map
+	// runTraces caches the traces of run attempts resolved for their jobs until
+	// the run attempts themselves are traced
+	runTraces sync.Map
+	// runLocks serializes the processing of events that belong to the same
+	// workflow run so that run and job events are reconciled consistently
+	runLocks keyedMutex
 }
 
-// Run the GitHubTracer in a goroutine until it is called to quit
-func (ght *GitHubTracer) run() {
-	slog.Info("starting github tracer routine")
+// keyedMutex is a set of mutexes identified by a key
+type keyedMutex struct {
+	mu    sync.Mutex
+	locks map[string]*keyedMutexEntry
+}
+
+type keyedMutexEntry struct {
+	sync.Mutex
+	refs int
+}
+
+// lock locks the mutex for key and returns a function that unlocks it
+func (km *keyedMutex) lock(key string) func() {
+	km.mu.Lock()
+	if km.locks == nil {
+		km.locks = map[string]*keyedMutexEntry{}
+	}
+	entry, ok := km.locks[key]
+	if !ok {
+		entry = &keyedMutexEntry{}
+		km.locks[key] = entry
+	}
+	entry.refs++
+	km.mu.Unlock()
+
+	entry.Lock()
+	return func() {
+		entry.Unlock()
+		km.mu.Lock()
+		entry.refs--
+		if entry.refs == 0 {
+			delete(km.locks, key)
+		}
+		km.mu.Unlock()
+	}
+}
+
+// start launches n workers that trace queued workflow runs until the
+// GitHubTracer is called to quit. done is closed once all workers have exited.
+func (ght *GitHubTracer) start(n int) {
+	slog.Info("starting github tracer workers", "workers", n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			ght.run(worker)
+		}(i)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ght.sweep()
+	}()
+	go func() {
+		wg.Wait()
+		close(ght.done)
+	}()
+}
+
+// Run a single GitHubTracer worker until it is called to quit
+func (ght *GitHubTracer) run(worker int) {
 	for {
-		select {
-		case <-ght.quit:
-			slog.Info("closing the github tracer routine")
+		item, ok := ght.queue.pop(ght.quit)
+		if !ok {
+			slog.Info("closing the github tracer worker", "worker", worker)
 			return
+		}
 
-		case e := <-ght.queue:
-			slog.Info("received workflow run event")
-			fullname := e.Repo.GetFullName()
-			parts := strings.Split(fullname, "/")
-			owner, repo := parts[0], parts[1]
-			err := ght.traceWorkflowRun(owner, repo, e.WorkflowRun)
-			if err != nil {
-				slog.Error("failed to trace workflow run", "error", err)
-			} else {
-				slog.Info("successfully traced workflow run", "run_id", *e.WorkflowRun.ID)
-			}
+		slog.Info("received workflow event", "worker", worker, "run_id", item.runID())
+		queueWait.Observe(time.Since(item.readyAt()).Seconds())
+		workersInFlight.Inc()
+		err := ght.process(item)
+		if err == nil {
+			err = ght.flushTelemetry()
+		}
+		workersInFlight.Dec()
+		if err != nil {
+			ght.handleFailure(item, err)
+			continue
+		}
+		slog.Info("successfully traced workflow event", "run_id", item.runID())
+		eventsTraced.WithLabelValues(item.event()).Inc()
+		if err := ght.queue.ack(item); err != nil {
+			slog.Error("failed to ack workflow event", "run_id", item.runID(), "error", err)
 		}
 	}
 }
 
-// traceWorkflowRun traces a given workflow run
+// telemetryFlushTimeout bounds the export of a traced event's telemetry
+const telemetryFlushTimeout = 30 * time.Second
+
+// flushTelemetry exports the spans and log records of a traced event before it
+// is acked. It does not use the tracer's context, which is cancelled on
+// shutdown while the workers finish their events.
+func (ght *GitHubTracer) flushTelemetry() error {
+	if ght.flush == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), telemetryFlushTimeout)
+	defer cancel()
+	if err := ght.flush(ctx); err != nil {
+		return fmt.Errorf("%w: %w", errTelemetryFlush, err)
+	}
+	return nil
+}
+
+// process traces the workflow run or job carried by a queue item. A panic while
+// processing the item is returned as an error so that it only fails this item.
+func (ght *GitHubTracer) process(item *queueItem) (err error) {
+	ctx := selfPropagator.Extract(ght.ctx, propagation.MapCarrier(item.TraceContext))
+	_, waitSpan := selfTracer.Start(ctx, "queue wait", trace.WithTimestamp(item.readyAt()))
+	waitSpan.End()
+	ctx, span := selfTracer.Start(ctx, "process "+item.event(), trace.WithAttributes(
+		attribute.Int64("github.run_id", item.runID()),
+		attribute.Int("exporter.attempts", item.Attempts),
+	))
+	defer func() {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}()
+	defer func() {
+		if r := recover(); r != nil {
+			slog.Error("recovered from panic while tracing workflow event", "run_id", item.runID(), "stack", string(debug.Stack()))
+			err = fmt.Errorf("panic while tracing workflow event: %v", r)
+		}
+	}()
+
+	parts := strings.Split(item.repo(), "/")
+	if len(parts) != 2 {
+		return fmt.Errorf("invalid repository name %q", item.repo())
+	}
+	owner, repo := parts[0], parts[1]
+	unlock := ght.runLocks.lock(fmt.Sprintf("%s/%d", item.repo(), item.runID()))
+	defer unlock()
+
+	if item.Job != nil {
+		return ght.traceWorkflowJobEvent(ctx, owner, repo, item.Job.WorkflowJob)
+	}
+	return ght.traceWorkflowRun(ctx, owner, repo, item.Run.WorkflowRun)
+}
+
+// handleFailure schedules a failed item to be retried, or moves it to the
+// dead letter store if the error is permanent or it ran out of attempts.
+func (ght *GitHubTracer) handleFailure(item *queueItem, err error) {
+	runID := item.runID()
+	// If we are shutting down, leave the item in the store to be replayed on startup
+	if ght.ctx.Err() != nil {
+		slog.Info("shutting down, workflow run will be replayed on startup", "run_id", runID)
+		return
+	}
+
+	item.Attempts++
+	item.LastError = err.Error()
+	if !isRetryable(err) || item.Attempts >= ght.retry.maxAttempts {
+		slog.Error("failed to trace workflow run, moving it to the dead letter store",
+			"run_id", runID, "attempts", item.Attempts, "error", err)
+		eventsFailed.WithLabelValues(item.event(), "dead_lettered").Inc()
+		if err := ght.queue.bury(item); err != nil {
+			slog.Error("failed to dead-letter workflow run", "run_id", runID, "error", err)
+		}
+		return
+	}
+
+	eventsFailed.WithLabelValues(item.event(), "retried").Inc()
+	delay := ght.retry.delay(item.Attempts, err)
+	slog.Warn("failed to trace workflow run, retrying",
+		"run_id", runID, "attempts", item.Attempts, "delay", delay, "error", err)
+	if err := ght.queue.retry(item, delay); err != nil {
+		slog.Error("failed to schedule workflow run retry", "run_id", runID, "error", err)
+	}
+}
+
+// traceWorkflowRun traces the latest attempt of a workflow run, along with any
+// earlier attempts that have not been traced yet. Each attempt is a separate
+// trace that links to the trace of the attempt before it.
 func (ght *GitHubTracer) traceWorkflowRun(
+	ctx context.Context,
 	owner,
 	repo string,
 	run *github.WorkflowRun,
 ) error {
-	workflowCtx, workflowSpan := tracer.Start(
-		context.Background(),
-		*run.Name,
-		trace.WithTimestamp(*run.CreatedAt.GetTime()),
+	for attempt := 1; attempt < run.GetRunAttempt(); attempt++ {
+		traced, err := ght.tracedAttempt(owner, repo, run.GetID(), attempt)
+		if err != nil {
+			return err
+		}
+		if traced {
+			continue
+		}
+		slog.Info("tracing previous workflow run attempt", "run_id", run.GetID(), "attempt", attempt)
+		attemptRun, _, err := ght.ghclient.Actions.GetWorkflowRunAttempt(ctx, owner, repo, run.GetID(), attempt, nil)
+		if err != nil {
+			return fmt.Errorf("error retrieving workflow run attempt: %w", err)
+		}
+		if err := ght.traceWorkflowRunAttempt(ctx, owner, repo, attemptRun); err != nil {
+			return err
+		}
+	}
+	return ght.traceWorkflowRunAttempt(ctx, owner, repo, run)
+}
+
+// traceWorkflowRunAttempt traces a single attempt of a workflow run, linking it
+// to the previous attempt if there is one.
+func (ght *GitHubTracer) traceWorkflowRunAttempt(
+	ctx context.Context,
+	owner,
+	repo string,
+	run *github.WorkflowRun,
+) (err error) {
+	attempt := run.GetRunAttempt()
+
+	// The workflow file models the dependencies, matrices, reusable workflow
+	// calls and triggers of the run. Without it they are inferred from job names.
+	wd, err := ght.getWorkflowDefinition(ctx, owner, repo, run)
+	if err != nil {
+		slog.Warn("failed to retrieve workflow definition, the run will be modelled from job names only",
+			"run_id", run.GetID(), "error", err)
+	}
+	// Reuse the trace resolved for the jobs of the run attempt if there is one
+	var rt runTrace
+	var tr *trigger
+	if entry, ok := ght.runTraces.LoadAndDelete(string(attemptKey(owner, repo, run.GetID(), attempt))); ok {
+		rt, tr = entry.(runTraceEntry).rt, entry.(runTraceEntry).tr
+	} else if rt, tr, err = ght.resolveRunTrace(ctx, owner, repo, run, wd); err != nil {
+		return fmt.Errorf("error resolving triggering workflow run: %w", err)
+	}
+
+	ctx, span := selfTracer.Start(ctx, "trace workflow run attempt",
+		trace.WithLinks(trace.Link{SpanContext: rt.spanContext(runSpanKey)}),
 		trace.WithAttributes(
-			attribute.String("github.owner", owner),
-			attribute.String("github.repo", repo),
-			attribute.Int64("github.workflow_id", *run.WorkflowID),
-			attribute.Int64("github.run_id", *run.ID),
-			attribute.Int("github.run_number", *run.RunNumber),
-			attribute.Int("github.run_attempt", *run.RunAttempt),
-			attribute.String("github.html_url", *run.HTMLURL),
-			attribute.String("github.created_at", run.CreatedAt.String()),
-			attribute.String("github.run_started_at", run.RunStartedAt.String()),
-			attribute.String("github.updated_at", run.UpdatedAt.String()),
-			attribute.String("github.event", *run.Event),
-			attribute.String("github.status", *run.Status),
-			attribute.String("github.conclusion", *run.Conclusion),
-			attribute.String("github.head_branch", *run.HeadBranch),
-			attribute.String("github.head_sha", *run.HeadSHA),
-			attribute.String("github.head_sha", *run.HeadSHA),
+			attribute.Int64("github.run_id", run.GetID()),
+			attribute.Int("github.run_attempt", attempt),
+			attribute.String("ci.trace_id", rt.traceID.String()),
 		),
 	)
+	// The run span is left unended if the attempt fails, so that it is only
+	// exported once, by the retry that succeeds
+	defer func() {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}()
 
-	// Add pull request attributes if this is a workflow triggered from a pull request
-	if len(run.PullRequests) > 0 {
-		workflowSpan.SetAttributes(
-			attribute.String("github.head_ref", *run.PullRequests[0].Head.Ref),
-			attribute.String("github.base_ref", *run.PullRequests[0].Base.Ref),
-			attribute.String("github.base_sha", *run.PullRequests[0].Base.SHA),
-			attribute.String("github.pull_request.url", *run.PullRequests[0].URL),
-		)
+	var links []trace.Link
+	if attempt > 1 {
+		previous := newRunTrace(owner, repo, run.GetID(), attempt-1)
+		if tr != nil && ght.triggerMode == triggerModeParent {
+			previous.traceID = rt.traceID
+		}
+		links = append(links, trace.Link{
+			SpanContext: previous.spanContext(runSpanKey),
+			Attributes: []attribute.KeyValue{
+				attribute.Int("github.run_attempt", attempt-1),
+			},
+		})
+	}
+	runCtx := rt.context()
+	if tr != nil {
+		if ght.triggerMode == triggerModeParent {
+			runCtx = trace.ContextWithRemoteSpanContext(runCtx, tr.spanContext)
+		} else {
+			links = append(links, tr.links()...)
+		}
 	}
 
-	// Create a span for the queue time
-	_, queueSpan := tracer.Start(
-		workflowCtx,
-		"queue",
-		trace.WithTimestamp(*run.CreatedAt.GetTime()),
+	runStart, runEnd := runTimes(run)
+	workflowCtx, workflowSpan := startSpan(
+		runCtx,
+		runSpanKey,
+		run.GetName(),
+		trace.WithTimestamp(runStart),
+		trace.WithLinks(links...),
+		trace.WithSpanKind(ght.attrMode.runSpanKind()),
+		trace.WithAttributes(runAttributes(owner, repo, run, ght.attrMode)...),
 	)
+	if tr != nil {
+		workflowSpan.SetAttributes(attribute.Int64("github.triggered_by.run_id", tr.run.GetID()))
+	}
 
-	// Retrieve the jobs for a workflow
-	jobs, _, err := ght.ghclient.Actions.ListWorkflowJobs(ght.ctx, owner, repo, *run.ID, nil)
+	// Retrieve the jobs for this attempt of the workflow
+	jobs, totalCount, err := ght.listWorkflowJobs(ctx, owner, repo, run.GetID(), attempt)
 	if err != nil {
 		return fmt.Errorf("error retrieving workflow run jobs: %w", err)
 	}
+	// Record both counts so that missing jobs can be detected
+	workflowSpan.SetAttributes(
+		attribute.Int("github.jobs.total_count", totalCount),
+		attribute.Int("github.jobs.traced_count", len(jobs)),
+	)
+
+	// Model the dependencies between jobs
+	graph := newJobGraph(wd, jobs)
+	workflowSpan.SetAttributes(graph.runAttributes()...)
 
-	// End the queue span at the first job's start time
-	if len(jobs.Jobs) > 0 {
-		queueSpan.End(trace.WithTimestamp(*jobs.Jobs[0].StartedAt.GetTime()))
+	// Group the jobs created from a matrix under a span covering the whole fan-out
+	parents := map[int64]context.Context{}
+	matrices := map[int64]*matrixGroup{}
+	for _, group := range matrixGroups(wd, jobs) {
+		matrixCtx := ght.traceMatrix(workflowCtx, group)
+		for _, job := range group.jobs {
+			parents[job.GetID()] = matrixCtx
+			matrices[job.GetID()] = group
+		}
+	}
+	// Nest the jobs of reusable workflows under a span for each call, within
+	// the matrix of the calling job if there is one
+	for _, call := range workflowCalls(owner, repo, run, wd, jobs) {
+		callParent, ok := parents[call.jobs[0].GetID()]
+		if !ok {
+			callParent = workflowCtx
+		}
+		callCtx := ght.traceWorkflowCall(callParent, call)
+		for _, job := range call.jobs {
+			parents[job.GetID()] = callCtx
+		}
 	}
 
 	// Print the jobs
-	for _, job := range jobs.Jobs {
+	reexecuted := 0
+	var failedJobs []string
+	for _, job := range jobs {
+		if failed(job.Conclusion) {
+			failedJobs = append(failedJobs, job.GetName())
+		}
+		// Jobs that succeeded in an earlier attempt are carried over when only
+		// failed jobs are re-run
+		carried := carriedOver(run, job)
+		if !carried {
+			reexecuted++
+		}
+		// Skip jobs that were already exported from their workflow_job event or
+		// by an earlier try of this attempt that failed
+		exported, err := ght.exportedJob(owner, repo, run.GetID(), attempt, job.GetID())
+		if err != nil {
+			return err
+		}
+		if exported {
+			continue
+		}
+		// Collect the logs before tracing the job so that the errors and
+		// warnings in them are recorded on its steps, carried over jobs had
+		// theirs collected with their own attempt
+		var counts logCounts
+		if !carried {
+			if counts, err = ght.getWorkflowJobLogs(ctx, rt, owner, repo, run.GetName(), run.GetID(), job); err != nil {
+				return err
+			}
+		}
 		// Trace the workflow job
-		jobSpanTraceID, err := ght.traceWorkflowJob(workflowCtx, owner, repo, job)
+		jobParent, ok := parents[job.GetID()]
+		if !ok {
+			jobParent = workflowCtx
+		}
+		err = ght.traceWorkflowJob(ctx, jobParent, owner, repo, job, !carried, counts,
+			trace.WithLinks(graph.links(rt, job.GetID())...),
+			trace.WithAttributes(attribute.Bool("github.job.critical_path", graph.critical[job.GetID()])),
+			trace.WithAttributes(matrices[job.GetID()].jobAttributes(job)...),
+		)
 		if err != nil {
 			return fmt.Errorf("error tracing workflow job: %w", err)
 		}
-		// Collect the logs
-		if err := ght.getWorkflowJobLogs(jobSpanTraceID, owner, repo, run, job); err != nil {
-			return err
+		// Mark the job as exported so that a retry does not export it twice
+		if err := ght.recordJob(owner, repo, run.GetID(), attempt, job.GetID()); err != nil {
+			return fmt.Errorf("failed to record exported workflow job: %w", err)
 		}
+		// Count the job once it is marked, so that a retry does not count it again
+		if !carried {
+			ght.metrics.recordJob(owner, repo, run.GetEvent(), job)
+		}
+	}
+	workflowSpan.SetAttributes(attribute.Int("github.jobs.reexecuted_count", reexecuted))
+	setConclusionStatus(workflowSpan, run.Conclusion, runErrorDescription(run, failedJobs))
+	workflowSpan.End(trace.WithTimestamp(runEnd))
+	ght.metrics.recordRun(owner, repo, run)
+	if tr != nil && ght.triggerMode == triggerModeLink {
+		ght.traceTrigger(run, rt, tr)
 	}
-	if run.Conclusion != nil {
-		if run.Conclusion == github.String("failure") {
-			workflowSpan.SetStatus(codes.Error, "workflow run failed")
+	if ght.receiver != nil {
+		if err := ght.receiver.flush(ctx, rt, jobs); err != nil {
+			slog.Warn("failed to export spans received from workflow steps", "run_id", run.GetID(), "error", err)
 		}
 	}
-	workflowSpan.End(trace.WithTimestamp(*run.UpdatedAt.GetTime()))
+
+	if err := ght.recordAttempt(owner, repo, run.GetID(), attempt); err != nil {
+		slog.Warn("failed to record traced workflow run attempt", "run_id", run.GetID(), "attempt", attempt, "error", err)
+	}
 	return nil
 }
 
+// traceWorkflowJobEvent traces a workflow job as soon as it completes, under the
+// trace of the run attempt it belongs to. The run's root span is exported
+// later, once the workflow run itself completes.
+func (ght *GitHubTracer) traceWorkflowJobEvent(
+	ctx context.Context,
+	owner,
+	repo string,
+	job *github.WorkflowJob,
+) error {
+	runID, attempt := job.GetRunID(), int(job.GetRunAttempt())
+	// If the run attempt was already traced, it exported this job as well
+	traced, err := ght.tracedAttempt(owner, repo, runID, attempt)
+	if err != nil {
+		return err
+	}
+	exported, err := ght.exportedJob(owner, repo, runID, attempt, job.GetID())
+	if err != nil {
+		return err
+	}
+	if traced || exported {
+		slog.Debug("workflow job already traced", "run_id", runID, "job_id", job.GetID())
+		return nil
+	}
+
+	entry, err := ght.jobRunTrace(ctx, owner, repo, job)
+	if err != nil {
+		return err
+	}
+	rt := entry.rt
+	ctx, span := selfTracer.Start(ctx, "trace workflow job",
+		trace.WithLinks(trace.Link{SpanContext: rt.spanContext(jobSpanKey(job.GetID()))}),
+		trace.WithAttributes(
+			attribute.Int64("github.job.id", job.GetID()),
+			attribute.String("ci.trace_id", rt.traceID.String()),
+		),
+	)
+	defer span.End()
+
+	counts, err := ght.getWorkflowJobLogs(ctx, rt, owner, repo, job.GetWorkflowName(), runID, job)
+	if err != nil {
+		return err
+	}
+	// Parent the job under the span of its matrix or reusable workflow call,
+	// which is exported along with the run span once the run completes
+	jobs := []*github.WorkflowJob{job}
+	parentKey := runSpanKey
+	var matrix *matrixGroup
+	if groups := matrixGroups(entry.wd, jobs); len(groups) > 0 {
+		matrix = groups[0]
+		parentKey = matrixSpanKey(matrix.id)
+	}
+	if calls := workflowCalls(owner, repo, entry.run, entry.wd, jobs); len(calls) > 0 {
+		parentKey = workflowCallSpanKey(calls[0].name)
+	}
+	// The jobs a job needs have completed before it started, so they are listed
+	graph := newJobGraph(nil, nil)
+	if id, ok := entry.wd.jobID(job.GetName()); ok && len(entry.wd.Jobs[id].neededJobs()) > 0 {
+		attemptJobs, _, err := ght.listWorkflowJobs(ctx, owner, repo, runID, attempt)
+		if err != nil {
+			return fmt.Errorf("error retrieving workflow run jobs: %w", err)
+		}
+		graph = newJobGraph(entry.wd, attemptJobs)
+	}
+	parentCtx := trace.ContextWithRemoteSpanContext(rt.context(), rt.spanContext(parentKey))
+	err = ght.traceWorkflowJob(ctx, parentCtx, owner, repo, job, true, counts,
+		trace.WithLinks(graph.links(rt, job.GetID())...),
+		trace.WithAttributes(matrix.jobAttributes(job)...),
+	)
+	if err != nil {
+		return fmt.Errorf("error tracing workflow job: %w", err)
+	}
+	// Only count the job once it is marked as exported, a retry would count it again
+	if err := ght.recordJob(owner, repo, runID, attempt, job.GetID()); err != nil {
+		return fmt.Errorf("failed to record exported workflow job: %w", err)
+	}
+	ght.metrics.recordJob(owner, repo, "", job)
+	return nil
+}
+
+// carriedOver reports whether a job listed for a run attempt was carried over
+// from an earlier attempt rather than executed as part of it
+func carriedOver(run *github.WorkflowRun, job *github.WorkflowJob) bool {
+	if job.GetRunAttempt() != 0 && job.GetRunAttempt() < int64(run.GetRunAttempt()) {
+		return true
+	}
+	// Fall back to timestamps if the job does not report its attempt
+	return run.RunStartedAt != nil && job.CompletedAt != nil && job.CompletedAt.Before(run.RunStartedAt.Time)
+}
+
+// listWorkflowJobs retrieves every job of a workflow run attempt, following pagination.
+// It also returns the total number of jobs reported by the GitHub API.
+func (ght *GitHubTracer) listWorkflowJobs(ctx context.Context, owner, repo string, runID int64, attempt int) ([]*github.WorkflowJob, int, error) {
+	opts := &github.ListOptions{PerPage: 100}
+	var jobs []*github.WorkflowJob
+	totalCount := 0
+	for {
+		page, resp, err := ght.listWorkflowJobsAttempt(ctx, owner, repo, runID, attempt, opts)
+		if err != nil {
+			return nil, 0, err
+		}
+		jobs = append(jobs, page.Jobs...)
+		totalCount = page.GetTotalCount()
+		if resp.NextPage == 0 {
+			return jobs, totalCount, nil
+		}
+		opts.Page = resp.NextPage
+	}
+}
+
+// listWorkflowJobsAttempt lists a page of the jobs for a specific workflow run attempt.
+//
+// GitHub API docs: https://docs.github.com/rest/actions/workflow-jobs#list-jobs-for-a-workflow-run-attempt
+func (ght *GitHubTracer) listWorkflowJobsAttempt(
+	ctx context.Context,
+	owner,
+	repo string,
+	runID int64,
+	attempt int,
+	opts *github.ListOptions,
+) (*github.Jobs, *github.Response, error) {
+	u := fmt.Sprintf("repos/%v/%v/actions/runs/%v/attempts/%v/jobs?per_page=%v&page=%v",
+		owner, repo, runID, attempt, opts.PerPage, opts.Page)
+	req, err := ght.ghclient.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	jobs := new(github.Jobs)
+	resp, err := ght.ghclient.Do(ctx, req, jobs)
+	if err != nil {
+		return nil, resp, err
+	}
+	return jobs, resp, nil
+}
+
 func (ght *GitHubTracer) traceWorkflowJob(
+	ctx,
 	workflowCtx context.Context,
 	owner,
 	repo string,
 	job *github.WorkflowJob,
-) (string, error) {
-	jobCtx, jobSpan := tracer.Start(
+	reexecuted bool,
+	counts logCounts,
+	opts ...trace.SpanStartOption,
+) error {
+	jobStart, jobEnd := jobTimes(job, time.Now())
+	opts = append(opts,
+		trace.WithTimestamp(jobStart),
+		trace.WithAttributes(jobAttributes(job, reexecuted, ght.attrMode)...),
+	)
+	jobCtx, jobSpan := startSpan(
 		workflowCtx,
-		*job.Name,
-		trace.WithTimestamp(*job.StartedAt.GetTime()),
-		trace.WithAttributes(
-			attribute.Int64("github.job.id", *job.ID),
-			attribute.Int64("github.job.run_id", *job.RunID),
-			attribute.String("github.job.name", *job.Name),
-			attribute.String("github.job.status", *job.Status),
-			attribute.String("github.job.conclusion", *job.Conclusion),
-			attribute.String("github.job.html_url", *job.HTMLURL),
-			attribute.String("github.job.started_at", job.StartedAt.String()),
-			attribute.String("github.job.completed_at", job.CompletedAt.String()),
-			attribute.StringSlice("github.job.runs_on", job.Labels),
-		),
+		jobSpanKey(job.GetID()),
+		job.GetName(),
+		opts...,
 	)
 
-	// Add runner attributes if available
-	if job.RunnerGroupID != nil {
-		jobSpan.SetAttributes(
-			attribute.Int64("github.job.runner_group_id", *job.RunnerGroupID),
-			attribute.String("github.job.runner_group_name", *job.RunnerGroupName),
-			attribute.String("github.job.runner_name", *job.RunnerName),
+	// Create a span for the time the job waited for a runner. It ends when the
+	// job span starts, so it is a sibling of the job span rather than its child.
+	if job.CreatedAt != nil && job.StartedAt != nil {
+		_, queueSpan := startSpan(
+			workflowCtx,
+			jobQueueSpanKey(job.GetID()),
+			"queue "+job.GetName(),
+			trace.WithTimestamp(job.CreatedAt.Time),
+			trace.WithLinks(trace.Link{SpanContext: jobSpan.SpanContext()}),
+			trace.WithAttributes(queueAttributes(job, ght.attrMode)...),
 		)
+		queueSpan.End(trace.WithTimestamp(jobStart))
 	}
 
 	// Prints the steps
-	for _, step := range job.Steps {
-		err := ght.traceWorkflowStep(jobCtx, owner, repo, step)
-		if err != nil {
-			return "", fmt.Errorf("error tracing workflow step: %w", err)
+	for _, st := range jobStepTimes(job, jobStart) {
+		if err := ght.traceWorkflowStep(jobCtx, owner, repo, job, st, counts); err != nil {
+			return fmt.Errorf("error tracing workflow step: %w", err)
 		}
 	}
-	if job.Conclusion != nil {
-		if job.Conclusion == github.String("failure") {
-			jobSpan.SetStatus(codes.Error, "workflow job failed")
-		}
+	description := ""
+	if failed(job.Conclusion) {
+		description = ght.jobErrorDescription(ctx, owner, repo, job)
 	}
-	jobSpan.End(trace.WithTimestamp(*job.CompletedAt.GetTime()))
-	return jobSpan.SpanContext().TraceID().String(), nil
+	setConclusionStatus(jobSpan, job.Conclusion, description)
+	jobSpan.End(trace.WithTimestamp(jobEnd))
+	return nil
 }
 
 // traceWorkflowStep traces a given workflow step
@@ -218,27 +680,35 @@ func (ght *GitHubTracer) traceWorkflowStep(
 	jobCtx context.Context,
 	owner,
 	repo string,
-	step *github.TaskStep,
+	job *github.WorkflowJob,
+	st stepTime,
+	counts logCounts,
 ) error {
-	_, stepSpan := tracer.Start(
+	step := st.step
+	_, stepSpan := startSpan(
 		jobCtx,
-		*step.Name,
-		trace.WithTimestamp(*step.StartedAt.GetTime()),
-		trace.WithAttributes(
-			attribute.String("github.step.name", *step.Name),
-			attribute.String("github.step.status", *step.Status),
-			attribute.String("github.step.conclusion", *step.Conclusion),
-			attribute.String("github.step.started_at", step.StartedAt.String()),
-			attribute.String("github.step.completed_at", step.CompletedAt.String()),
-			attribute.Int64("github.step.number", *step.Number),
-		),
+		stepSpanKey(job.GetID(), step.GetNumber()),
+		step.GetName(),
+		trace.WithTimestamp(st.start),
+		trace.WithAttributes(stepAttributes(step)...),
 	)
-	if step.Conclusion != nil {
-		if step.Conclusion == github.String("failure") {
-			stepSpan.SetStatus(codes.Error, "workflow step failed")
+	// Point at the step's own section of the job log
+	if url := stepLogURL(job, step); url != "" {
+		stepSpan.SetAttributes(attribute.String("github.step.log.url", url))
+	}
+	// Record the errors and warnings found in the step's log, if it was read
+	if counts != nil && step.StartedAt != nil {
+		count := counts[step.GetNumber()]
+		if count == nil {
+			count = &stepLogCount{}
 		}
+		stepSpan.SetAttributes(
+			attribute.Int("github.step.log.errors", count.errors),
+			attribute.Int("github.step.log.warnings", count.warnings),
+		)
 	}
-	stepSpan.End(trace.WithTimestamp(*step.CompletedAt.GetTime()))
+	setConclusionStatus(stepSpan, step.Conclusion, conclusionDescription("step", step.GetConclusion()))
+	stepSpan.End(trace.WithTimestamp(st.end))
 	return nil
 }
 
@@ -247,54 +717,160 @@ const (
 	timestampLayout = "2006-01-02T15:04:05.9999999Z"
 )
 
-// getWorkflowJobLogs retrieves the logs for a given workflow job
-func (ght *GitHubTracer) getWorkflowJobLogs(
-	jobSpanTraceID,
-	owner,
-	repo string,
-	run *github.WorkflowRun,
-	job *github.WorkflowJob,
-) error {
-	// Skip ingesting logs if we don't have a loki endpoint configured
-	if ght.lokiClient == nil {
-		slog.Debug("loki client not configured, not retrieving logs")
-		return nil
-	}
+// downloadWorkflowJobLogs starts downloading the logs of a workflow job. The
+// caller reads the logs from the returned body as they arrive and closes it.
+func (ght *GitHubTracer) downloadWorkflowJobLogs(ctx context.Context, owner, repo string, job *github.WorkflowJob) (_ io.ReadCloser, err error) {
+	ctx, span := selfTracer.Start(ctx, "download logs", trace.WithAttributes(
+		attribute.Int64("github.job.id", job.GetID()),
+	))
+	defer func() {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}()
 
 	// Get the log retrieval url
-	url, _, err := ght.ghclient.Actions.GetWorkflowJobLogs(ght.ctx, owner, repo, *job.ID, 1)
+	url, _, err := ght.ghclient.Actions.GetWorkflowJobLogs(ctx, owner, repo, job.GetID(), 1)
 	if err != nil {
-		return fmt.Errorf("error retrieving workflow job logs url: %w", err)
+		return nil, fmt.Errorf("error retrieving workflow job logs url: %w", err)
 	}
 
 	// Retrieve the logs
-	req, err := http.NewRequestWithContext(ght.ctx, "GET", url.String(), nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", url.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating request for retrieving workflow job logs: %w", err)
+	}
+	resp, err := ght.ghclient.BareDo(ctx, req)
 	if err != nil {
-		return fmt.Errorf("error creating request for retrieving workflow job logs: %w", err)
+		// The signed log url is short lived, the run needs to be retried to get a new one
+		if resp != nil && (resp.StatusCode == http.StatusForbidden || resp.StatusCode == http.StatusNotFound) {
+			return nil, fmt.Errorf("error retrieving workflow job logs: %w: %w", errLogURLExpired, err)
+		}
+		return nil, fmt.Errorf("error retrieving workflow job logs: %w", err)
+	}
+	return resp.Body, nil
+}
+
+// getWorkflowJobLogs retrieves the logs for a given workflow job. It returns the
+// errors and warnings counted in the log of each step, or nil if the logs were
+// not retrieved.
+func (ght *GitHubTracer) getWorkflowJobLogs(
+	ctx context.Context,
+	rt runTrace,
+	owner,
+	repo,
+	workflowName string,
+	runID int64,
+	job *github.WorkflowJob,
+) (logCounts, error) {
+	// Skip ingesting logs if neither loki nor otlp logs are configured
+	if ght.loki == nil && ght.logger == nil {
+		slog.Debug("no log exporter configured, not retrieving logs")
+		return nil, nil
+	}
+	// Jobs that never ran have no logs
+	if job.StartedAt == nil || job.GetConclusion() == "skipped" {
+		slog.Debug("workflow job did not run, not retrieving logs", "job_id", job.GetID())
+		return nil, nil
 	}
-	var logLinesRaw bytes.Buffer
-	_, err = ght.ghclient.Do(ght.ctx, req, &logLinesRaw)
+
+	body, err := ght.downloadWorkflowJobLogs(ctx, owner, repo, job)
 	if err != nil {
-		return fmt.Errorf("error retrieving workflow job logs: %w", err)
+		return nil, err
 	}
+	defer body.Close()
+	_, pushSpan := selfTracer.Start(ctx, "push logs", trace.WithAttributes(
+		attribute.Int64("github.job.id", job.GetID()),
+	))
+	defer pushSpan.End()
 
-	labels := model.LabelSet{
+	fields := map[string]string{
 		// Allow us to link the logs to the job span
-		"trace_id": model.LabelValue(jobSpanTraceID),
-		// Common labels to associate with the run
-		"repo_owner":        model.LabelValue(owner),
-		"repo_name":         model.LabelValue(repo),
-		"workflow_name":     model.LabelValue(run.GetName()),
-		"workflow_id":       model.LabelValue(github.Stringify(run.ID)),
-		"workflow_job_name": model.LabelValue(job.GetName()),
-		"workflow_job_id":   model.LabelValue(github.Stringify(job.ID)),
+		logFieldTraceID: rt.traceID.String(),
+		// Common fields to associate with the run
+		logFieldRepoOwner:    owner,
+		logFieldRepoName:     repo,
+		logFieldWorkflowName: workflowName,
+		logFieldWorkflowID:   github.Stringify(runID),
+		logFieldJobName:      job.GetName(),
+		logFieldJobID:        github.Stringify(job.ID),
 	}
+	// Attributes of the run and job shared by every otlp log record
+	recordAttrs := []otellog.KeyValue{
+		otellog.String("github.repository", owner+"/"+repo),
+		otellog.String("github.workflow", workflowName),
+		otellog.Int64("github.run_id", runID),
+		otellog.Int64("github.job.id", job.GetID()),
+		otellog.String("github.job.name", job.GetName()),
+	}
+	jobSpanContext := rt.spanContext(jobSpanKey(job.GetID()))
 
 	// For each line in the log, parse the timestamp from the log line
 	// and use that as the timestamp to ingest into Loki
-	logLines := strings.Split(logLinesRaw.String(), "\n")
-	lastTimestamp := job.StartedAt.GetTime()
-	for _, log := range logLines {
+	lines := newLogScanner(body, ght.logMaxBytes)
+	lastTimestamp, _ := jobTimes(job, time.Now())
+	steps := newStepSplitter(rt, job, lastTimestamp)
+	var batch *lokiBatch
+	if ght.loki != nil {
+		batch = ght.loki.newBatch()
+	}
+	counts := logCounts{}
+	// pushFailed is set once Loki could not be reached or kept failing after
+	// retries, the rest of the log is dropped rather than waiting for Loki to
+	// time out on every batch. Batches Loki rejected do not stop the others.
+	pushFailed := false
+	var lineFields map[string]string
+	var lineSection *stepSection
+	// export sends a line of the log, labelled with the step that wrote it so
+	// that it can be found from the step's span
+	export := func(ts time.Time, line, content string, section *stepSection) {
+		a := annotateLogLine(content)
+		if section != nil {
+			counts.add(section.number, a.level)
+		}
+		if ght.logger != nil {
+			if section != nil {
+				ght.emitLogRecord(section.spanContext, ts, content, a,
+					append(recordAttrs, otellog.Int64("github.step.number", section.number))...)
+			} else {
+				ght.emitLogRecord(jobSpanContext, ts, content, a, recordAttrs...)
+			}
+		}
+		if pushFailed {
+			lokiLinesDropped.Inc()
+		}
+		if batch == nil || pushFailed {
+			return
+		}
+		if lineFields == nil || section != lineSection {
+			lineFields, lineSection = fields, section
+			if section != nil {
+				lineFields = maps.Clone(fields)
+				lineFields[logFieldSpanID] = section.spanContext.SpanID().String()
+				lineFields[logFieldStepNumber] = strconv.FormatInt(section.number, 10)
+			}
+		}
+		annotated := maps.Clone(lineFields)
+		annotated[logFieldLevel] = string(a.level)
+		if a.file != "" {
+			annotated[logFieldCodeFile] = a.file
+		}
+		if a.line != 0 {
+			annotated[logFieldCodeLine] = strconv.Itoa(a.line)
+		}
+		if a.column != 0 {
+			annotated[logFieldCodeColumn] = strconv.Itoa(a.column)
+		}
+		if err := batch.add(ctx, annotated, ts, line); err != nil {
+			pushFailed = lokiUnavailable(err)
+			ght.lokiPushFailed(pushSpan, job, err)
+		}
+	}
+
+	for lines.scan() {
+		log := lines.text()
 		// If the log line is empty, skip it
 		if len(log) == 0 {
 			continue
@@ -302,23 +878,45 @@ func (ght *GitHubTracer) getWorkflowJobLogs(
 
 		// Multi-line logs do not include the timestamp after the first line, so we need to
 		// parse the timestamp from the first line and apply it to all subsequent lines
-		timestamp, err := time.Parse(timestampLayout, log[:len(timestampLayout)])
-		if err != nil {
-			slog.Debug("error parsing timestamp from log line", "error", err)
-		} else {
-			// New timestamp found, update the last timestamp
-			lastTimestamp = &timestamp
+		content := log
+		if len(log) >= len(timestampLayout) {
+			timestamp, err := time.Parse(timestampLayout, log[:len(timestampLayout)])
+			if err != nil {
+				slog.Debug("error parsing timestamp from log line", "error", err)
+			} else {
+				// New timestamp found, update the last timestamp
+				lastTimestamp = timestamp
+				content = strings.TrimPrefix(log[len(timestampLayout):], " ")
+			}
 		}
-
-		// Queue the logs to be send to Loki
-		err = ght.lokiClient.Handle(
-			labels,
-			*lastTimestamp,
-			log,
-		)
-		if err != nil {
-			return fmt.Errorf("error queuing log line to be sent to loki: %w", err)
+		export(lastTimestamp, log, content, steps.section(lastTimestamp, content))
+	}
+	pushSpan.SetAttributes(
+		attribute.Int64("exporter.logs.bytes", lines.read),
+		attribute.Bool("exporter.logs.truncated", lines.truncated),
+	)
+	if lines.err != nil {
+		return nil, fmt.Errorf("error reading workflow job logs: %w", lines.err)
+	}
+	// Let readers of the log know that it does not end here
+	if lines.truncated {
+		slog.Warn("workflow job logs exceed the maximum size, truncating them", "job_id", job.GetID(), "max_bytes", ght.logMaxBytes)
+		marker := fmt.Sprintf(logTruncatedMarker, ght.logMaxBytes)
+		export(lastTimestamp, marker, marker, steps.section(lastTimestamp, marker))
+	}
+	if batch != nil && !pushFailed {
+		if err := batch.flush(ctx); err != nil {
+			ght.lokiPushFailed(pushSpan, job, err)
 		}
 	}
-	return nil
+	return counts, nil
+}
+
+// lokiPushFailed reports a failed push of a job's logs to Loki. The lines of
+// the push are counted as dropped, and the job is still traced so that an
+// unavailable Loki does not hold up or discard the traces.
+func (ght *GitHubTracer) lokiPushFailed(span trace.Span, job *github.WorkflowJob, err error) {
+	slog.Warn("failed to push workflow job logs to loki, dropping them", "job_id", job.GetID(), "error", err)
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
 }
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"strings"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Trace and span IDs for workflow runs are derived from GitHub identifiers so
+// that anyone who knows a run can compute its trace ID without a lookup, and
+// tracing the same run twice produces the same trace:
+//
+//	trace_id = hex(sha256("<owner>/<repo>/<run_id>/<run_attempt>"))[:32]
+//	span_id  = hex(sha256("<trace_id>/<span key>"))[:16]
+//
+// The owner and repo are lowercased. Span keys are listed below.
+const (
+	// runSpanKey is the key of a run attempt's root span
+	runSpanKey = "run"
+)
+
+// jobSpanKey is the key of a workflow job span
+func jobSpanKey(jobID int64) string {
+	return fmt.Sprintf("job/%d", jobID)
+}
+
+// jobQueueSpanKey is the key of the span a workflow job spent waiting for a runner
+func jobQueueSpanKey(jobID int64) string {
+	return fmt.Sprintf("job/%d/queue", jobID)
+}
+
+// matrixSpanKey is the key of the span grouping the jobs created from a matrix
+func matrixSpanKey(id string) string {
+	return "matrix/" + id
+}
+
+// workflowCallSpanKey is the key of the span of a reusable workflow call,
+// identified by the name of the calling job
+func workflowCallSpanKey(name string) string {
+	return "call/" + name
+}
+
+// triggerSpanKey is the key of the span recorded in the trace of a workflow run
+// for a run attempt it triggered
+func triggerSpanKey(runID int64, attempt int) string {
+	return fmt.Sprintf("triggered/%d/%d", runID, attempt)
+}
+
+// stepSpanKey is the key of a workflow step span
+func stepSpanKey(jobID, number int64) string {
+	return fmt.Sprintf("job/%d/step/%d", jobID, number)
+}
+
+// runTraceID derives the trace ID of a workflow run attempt
+func runTraceID(owner, repo string, runID int64, attempt int) trace.TraceID {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s/%s/%d/%d", strings.ToLower(owner), strings.ToLower(repo), runID, attempt)))
+	var traceID trace.TraceID
+	copy(traceID[:], sum[:])
+	return traceID
+}
+
+// deriveSpanID derives the ID of the span identified by key within a trace
+func deriveSpanID(traceID trace.TraceID, key string) trace.SpanID {
+	sum := sha256.Sum256([]byte(traceID.String() + "/" + key))
+	var spanID trace.SpanID
+	copy(spanID[:], sum[:])
+	return spanID
+}
+
+// runTrace identifies the trace a workflow run attempt is exported in
+type runTrace struct {
+	// seed is the run attempt's own trace ID, which its span IDs are derived from
+	seed trace.TraceID
+	// traceID is the trace the run attempt is exported in. It differs from seed
+	// when the run attempt is parented under the run that triggered it.
+	traceID trace.TraceID
+}
+
+// newRunTrace returns the trace of a workflow run attempt that is exported in its own trace
+func newRunTrace(owner, repo string, runID int64, attempt int) runTrace {
+	traceID := runTraceID(owner, repo, runID, attempt)
+	return runTrace{seed: traceID, traceID: traceID}
+}
+
+// spanContext returns the span context of the span identified by key
+func (rt runTrace) spanContext(key string) trace.SpanContext {
+	return trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    rt.traceID,
+		SpanID:     deriveSpanID(rt.seed, key),
+		TraceFlags: trace.FlagsSampled,
+	})
+}
+
+// context returns a context in which spans are started in the run attempt's trace
+func (rt runTrace) context() context.Context {
+	return withSpanIDSeed(withTraceID(context.Background(), rt.traceID), rt.seed)
+}
+
+type traceIDContextKey struct{}
+
+type spanKeyContextKey struct{}
+
+type spanIDSeedContextKey struct{}
+
+// withTraceID returns a context in which root spans use the given trace ID
+func withTraceID(ctx context.Context, traceID trace.TraceID) context.Context {
+	return context.WithValue(ctx, traceIDContextKey{}, traceID)
+}
+
+// withSpanIDSeed returns a context in which span IDs are derived from seed
+// instead of the ID of the trace the spans belong to. This keeps the span IDs of
+// a run attempt exported in the trace of another run the same as in its own trace.
+func withSpanIDSeed(ctx context.Context, seed trace.TraceID) context.Context {
+	return context.WithValue(ctx, spanIDSeedContextKey{}, seed)
+}
+
+// startSpan starts a span whose ID is derived from key. The returned context
+// carries the new span but not the key, so children must pick their own.
+func startSpan(ctx context.Context, key, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	_, span := tracer.Start(context.WithValue(ctx, spanKeyContextKey{}, key), name, opts...)
+	return trace.ContextWithSpan(ctx, span), span
+}
+
+// ciIDGenerator is an sdktrace.IDGenerator that derives IDs from the trace ID
+// and span key stored in the context, falling back to random IDs.
+type ciIDGenerator struct{}
+
+// NewIDs returns the trace ID from the context, or a random one, and a span ID
+func (g ciIDGenerator) NewIDs(ctx context.Context) (trace.TraceID, trace.SpanID) {
+	traceID, ok := ctx.Value(traceIDContextKey{}).(trace.TraceID)
+	if !ok {
+		binary.BigEndian.PutUint64(traceID[:8], rand.Uint64())
+		binary.BigEndian.PutUint64(traceID[8:], rand.Uint64())
+	}
+	return traceID, g.NewSpanID(ctx, traceID)
+}
+
+// NewSpanID derives a span ID from the span key and seed in the context, or returns a random one
+func (g ciIDGenerator) NewSpanID(ctx context.Context, traceID trace.TraceID) trace.SpanID {
+	if key, ok := ctx.Value(spanKeyContextKey{}).(string); ok {
+		if seed, ok := ctx.Value(spanIDSeedContextKey{}).(trace.TraceID); ok {
+			traceID = seed
+		}
+		return deriveSpanID(traceID, key)
+	}
+	var spanID trace.SpanID
+	binary.BigEndian.PutUint64(spanID[:], rand.Uint64())
+	return spanID
+}
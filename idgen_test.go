@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+// The expected IDs are computed with the commands documented in the README, e.g.
+//
+//	printf '%s' "taylormutch/github-actions-otel-exporter/1234567890/1" | sha256sum | cut -c1-32
+const (
+	testTraceID       = "c25499cb1af3616257021ea43742d2bc"
+	testSecondTraceID = "c7e97d64731d9c0fbfc9ce5ec192143f"
+)
+
+func TestRunTraceID(t *testing.T) {
+	tests := []struct {
+		name    string
+		owner   string
+		repo    string
+		attempt int
+		want    string
+	}{
+		{"lowercase", "taylormutch", "github-actions-otel-exporter", 1, testTraceID},
+		{"mixed case", "TaylorMutch", "GitHub-Actions-OTel-Exporter", 1, testTraceID},
+		{"second attempt", "taylormutch", "github-actions-otel-exporter", 2, testSecondTraceID},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := runTraceID(tt.owner, tt.repo, 1234567890, tt.attempt).String(); got != tt.want {
+				t.Errorf("runTraceID() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDeriveSpanID(t *testing.T) {
+	traceID := runTraceID("taylormutch", "github-actions-otel-exporter", 1234567890, 1)
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{runSpanKey, "bcfdb9aeb209a5be"},
+		{jobSpanKey(42), "25d3bfdc3a350591"},
+		{jobQueueSpanKey(42), "7a723641cd66e351"},
+		{stepSpanKey(42, 3), "86ed757ccee384b1"},
+		{matrixSpanKey("test"), "e8e68ac4d38d3634"},
+		{workflowCallSpanKey("deploy"), "67df868bff958e19"},
+		{triggerSpanKey(99, 1), "af990a03eb777c22"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			if got := deriveSpanID(traceID, tt.key).String(); got != tt.want {
+				t.Errorf("deriveSpanID(%q) = %s, want %s", tt.key, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCIIDGenerator(t *testing.T) {
+	own := newRunTrace("taylormutch", "github-actions-otel-exporter", 1234567890, 1)
+	// A run attempt exported in the trace of the second attempt keeps its span IDs
+	parented := runTrace{seed: own.seed, traceID: runTraceID("taylormutch", "github-actions-otel-exporter", 1234567890, 2)}
+
+	tests := []struct {
+		name        string
+		rt          runTrace
+		wantTraceID string
+	}{
+		{"own trace", own, testTraceID},
+		{"parented", parented, testSecondTraceID},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.WithValue(tt.rt.context(), spanKeyContextKey{}, runSpanKey)
+			traceID, spanID := ciIDGenerator{}.NewIDs(ctx)
+			if traceID.String() != tt.wantTraceID {
+				t.Errorf("trace ID = %s, want %s", traceID, tt.wantTraceID)
+			}
+			if spanID.String() != "bcfdb9aeb209a5be" {
+				t.Errorf("span ID = %s, want bcfdb9aeb209a5be", spanID)
+			}
+			if sc := tt.rt.spanContext(runSpanKey); sc.TraceID() != traceID || sc.SpanID() != spanID {
+				t.Errorf("spanContext() = %s/%s, want %s/%s", sc.TraceID(), sc.SpanID(), traceID, spanID)
+			}
+		})
+	}
+
+	// Spans without a key get random IDs
+	_, a := ciIDGenerator{}.NewIDs(context.Background())
+	_, b := ciIDGenerator{}.NewIDs(context.Background())
+	if a == b {
+		t.Errorf("span IDs without a key are both %s", a)
+	}
+}
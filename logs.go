@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/go-github/v58/github"
+	otellog "go.opentelemetry.io/otel/log"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// logExporter selects where the logs of workflow jobs are sent
+type logExporter string
+
+const (
+	// logExporterLoki pushes logs to Loki
+	logExporterLoki logExporter = "loki"
+	// logExporterOTLP exports logs as OTLP log records
+	logExporterOTLP logExporter = "otlp"
+	// logExporterBoth sends logs to both, to ease moving from one to the other
+	logExporterBoth logExporter = "both"
+)
+
+// parseLogExporter validates a log exporter from the configuration
+func parseLogExporter(exporter string) (logExporter, error) {
+	switch e := logExporter(exporter); e {
+	case logExporterLoki, logExporterOTLP, logExporterBoth:
+		return e, nil
+	}
+	return "", fmt.Errorf("invalid log exporter %q, must be one of loki, otlp or both", exporter)
+}
+
+// loki reports whether logs are pushed to Loki
+func (e logExporter) loki() bool {
+	return e == logExporterLoki || e == logExporterBoth
+}
+
+// otlp reports whether logs are exported as OTLP log records
+func (e logExporter) otlp() bool {
+	return e == logExporterOTLP || e == logExporterBoth
+}
+
+const (
+	// groupMarker and endGroupMarker open and close a collapsible group in a job log
+	groupMarker    = "##[group]"
+	endGroupMarker = "##[endgroup]"
+	// stepMarker is the group the runner opens at the start of each step it runs
+	stepMarker = groupMarker + "Run "
+	// postStepMarker is the first line the runner writes for each post step
+	postStepMarker = "Post job cleanup."
+)
+
+// stepSection identifies the step that wrote a section of a job log
+type stepSection struct {
+	number      int64
+	spanContext trace.SpanContext
+}
+
+// stepSplitter splits a job log into the sections written by each step. GitHub
+// only records when steps start and complete to the second, so lines are
+// assigned to steps by their timestamp, and the marker the runner writes at the
+// start of each step decides between two steps that share a second.
+type stepSplitter struct {
+	steps    []stepTime
+	sections []stepSection
+	current  int
+	// depth is the number of groups opened and not yet closed in the current step
+	depth int
+}
+
+// newStepSplitter returns a splitter for the log of a job. Steps that did not
+// run wrote nothing to the log and are left out.
+func newStepSplitter(rt runTrace, job *github.WorkflowJob, jobStart time.Time) *stepSplitter {
+	s := &stepSplitter{}
+	for _, st := range jobStepTimes(job, jobStart) {
+		if st.step.StartedAt == nil || st.step.GetConclusion() == "skipped" {
+			continue
+		}
+		s.steps = append(s.steps, st)
+		s.sections = append(s.sections, stepSection{
+			number:      st.step.GetNumber(),
+			spanContext: rt.spanContext(stepSpanKey(job.GetID(), st.step.GetNumber())),
+		})
+	}
+	return s
+}
+
+// section returns the step that wrote a line of the log, given the line without
+// its timestamp and the timestamp of the line or of the last line that had one.
+// Lines must be passed in order. It returns nil if no step of the job ran.
+func (s *stepSplitter) section(ts time.Time, line string) *stepSection {
+	if len(s.steps) == 0 {
+		return nil
+	}
+	// A group the step opened itself may be named like a step marker
+	marker := line == postStepMarker || (s.depth == 0 && strings.HasPrefix(line, stepMarker))
+	for s.current+1 < len(s.steps) {
+		next := s.steps[s.current+1]
+		if ts.Before(next.start.Truncate(time.Second)) {
+			break
+		}
+		// The line was written in the second the current step completed and
+		// the next one started, only a step marker moves on to the next step
+		if ts.Before(s.steps[s.current].end.Truncate(time.Second).Add(time.Second)) {
+			if marker {
+				s.current++
+				s.depth = 0
+			}
+			break
+		}
+		s.current++
+		s.depth = 0
+	}
+
+	switch {
+	case strings.HasPrefix(line, groupMarker):
+		s.depth++
+	case strings.HasPrefix(line, endGroupMarker) && s.depth > 0:
+		s.depth--
+	}
+	return &s.sections[s.current]
+}
+
+// stepLogURL returns the address of a step's section of the job log on GitHub
+func stepLogURL(job *github.WorkflowJob, step *github.TaskStep) string {
+	if job.HTMLURL == nil {
+		return ""
+	}
+	return job.GetHTMLURL() + "#step:" + strconv.FormatInt(step.GetNumber(), 10) + ":1"
+}
+
+// emitLogRecord exports a line of a job log as an OTLP log record, in the
+// context of the span of the job or step that wrote it
+func (ght *GitHubTracer) emitLogRecord(sc trace.SpanContext, ts time.Time, body string, a logAnnotation, attrs ...otellog.KeyValue) {
+	var record otellog.Record
+	record.SetTimestamp(ts)
+	record.SetObservedTimestamp(time.Now())
+	record.SetSeverity(a.level.severity())
+	record.SetSeverityText(strings.ToUpper(string(a.level)))
+	record.SetBody(otellog.StringValue(body))
+	record.AddAttributes(attrs...)
+	if a.file != "" {
+		record.AddAttributes(otellog.String("code.filepath", a.file))
+	}
+	if a.line != 0 {
+		record.AddAttributes(otellog.Int("code.lineno", a.line))
+	}
+	if a.column != 0 {
+		record.AddAttributes(otellog.Int("code.column", a.column))
+	}
+	ght.logger.Emit(trace.ContextWithSpanContext(context.Background(), sc), record)
+}
+
+const (
+	// maxLogLineBytes is the longest log line read, longer lines are cut short
+	maxLogLineBytes = 64 << 10
+	// lineTruncatedMarker is appended to log lines that were cut short
+	lineTruncatedMarker = " [line truncated]"
+	// logTruncatedMarker is the last line of logs that were not read to the end
+	logTruncatedMarker = "[log truncated after %d bytes]"
+)
+
+// logScanner reads a job log line by line without holding more than a line of
+// it in memory. Lines longer than maxLogLineBytes are cut short and the log is
+// only read up to a maximum size, even within a line.
+type logScanner struct {
+	r *bufio.Reader
+	// src is the log itself, r only reads up to maxBytes of it
+	src      io.Reader
+	maxBytes int64
+	read     int64
+	line     string
+	// truncated is set when the log was not read to the end because it is too large
+	truncated bool
+	eof       bool
+	err       error
+}
+
+// newLogScanner returns a scanner reading up to maxBytes of a log, or all of
+// it if maxBytes is 0
+func newLogScanner(r io.Reader, maxBytes int64) *logScanner {
+	s := &logScanner{src: r, maxBytes: maxBytes}
+	if maxBytes > 0 {
+		r = &io.LimitedReader{R: r, N: maxBytes}
+	}
+	s.r = bufio.NewReaderSize(r, maxLogLineBytes)
+	return s
+}
+
+// scan reads the next line, which is then available through text. It returns
+// false at the end of the log, when the maximum size is reached or on error.
+func (s *logScanner) scan() bool {
+	if s.eof || s.err != nil || s.truncated {
+		return false
+	}
+
+	chunk, err := s.r.ReadSlice('\n')
+	s.read += int64(len(chunk))
+	// The chunk is only valid until the next read
+	line := string(chunk)
+	cut := false
+	for err == bufio.ErrBufferFull {
+		cut = true
+		chunk, err = s.r.ReadSlice('\n')
+		s.read += int64(len(chunk))
+	}
+	if err == io.EOF && s.maxBytes > 0 && s.read >= s.maxBytes {
+		// Logs of exactly the maximum size are not truncated
+		if _, err := io.ReadFull(s.src, make([]byte, 1)); err == nil {
+			s.truncated = true
+		} else if err != io.EOF {
+			s.err = err
+			return false
+		}
+	}
+	switch {
+	case err == io.EOF:
+		s.eof = !s.truncated
+		if line == "" && !cut {
+			return false
+		}
+	case err != nil:
+		s.err = err
+		return false
+	}
+
+	// A line crossing the maximum size is cut short at it
+	if s.truncated && !strings.HasSuffix(line, "\n") {
+		cut = true
+	}
+	line = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+	if cut {
+		line += lineTruncatedMarker
+	}
+	s.line = line
+	return true
+}
+
+// text returns the line read by the last call to scan
+func (s *logScanner) text() string {
+	return s.line
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/v58/github"
+)
+
+func TestStepSplitterSharedSecond(t *testing.T) {
+	base := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	at := func(seconds int) *github.Timestamp {
+		return &github.Timestamp{Time: base.Add(time.Duration(seconds) * time.Second)}
+	}
+	step := func(number int64, name string, start, end int) *github.TaskStep {
+		return &github.TaskStep{
+			Number:      github.Int64(number),
+			Name:        github.String(name),
+			Conclusion:  github.String("success"),
+			StartedAt:   at(start),
+			CompletedAt: at(end),
+		}
+	}
+	job := &github.WorkflowJob{
+		ID: github.Int64(1),
+		Steps: []*github.TaskStep{
+			step(1, "Run make build", 0, 5),
+			step(2, "Run make test", 5, 7),
+			step(3, "Post Run actions/checkout", 7, 7),
+			step(4, "Post Run actions/setup-go", 7, 8),
+		},
+	}
+	s := newStepSplitter(newRunTrace("owner", "repo", 1, 1), job, base)
+
+	lines := []struct {
+		second int
+		line   string
+		want   int64
+	}{
+		{1, "##[group]Run make build", 1},
+		{2, "##[endgroup]", 1},
+		// The second step starts in the second the first completes, only its
+		// marker moves on to it
+		{5, "build done", 1},
+		{5, "##[group]Run make test", 2},
+		{5, "##[endgroup]", 2},
+		{6, "##[group]Run make test", 2},
+		{6, "##[endgroup]", 2},
+		{6, "##[group]Coverage", 2},
+		{7, "coverage: 80%", 2},
+		// A group the step opened itself is not a marker
+		{7, "##[group]Run coverage report", 2},
+		// Post steps are found by their marker whatever groups are still open
+		{7, "Post job cleanup.", 3},
+		// The groups of the previous step do not hide the marker of the next one
+		{7, "##[group]Run cleanup", 4},
+		{8, "done", 4},
+	}
+	for _, l := range lines {
+		got := s.section(base.Add(time.Duration(l.second)*time.Second), l.line)
+		if got == nil {
+			t.Fatalf("section(%q) = nil, want step %d", l.line, l.want)
+		}
+		if got.number != l.want {
+			t.Errorf("section(%q) at %ds = step %d, want step %d", l.line, l.second, got.number, l.want)
+		}
+	}
+}
+
+func TestLogScanner(t *testing.T) {
+	long := strings.Repeat("x", maxLogLineBytes+100)
+
+	tests := []struct {
+		name          string
+		log           string
+		maxBytes      int64
+		want          []string
+		wantTruncated bool
+	}{
+		{"empty log", "", 0, nil, false},
+		{"lines", "a\nb\n", 0, []string{"a", "b"}, false},
+		{"final line without newline", "a\nb", 0, []string{"a", "b"}, false},
+		{"crlf", "a\r\nb\r\n", 0, []string{"a", "b"}, false},
+		{"empty lines", "a\n\nb\n", 0, []string{"a", "", "b"}, false},
+		{
+			"line over 64 KiB",
+			long + "\nnext\n",
+			0,
+			[]string{long[:maxLogLineBytes] + lineTruncatedMarker, "next"},
+			false,
+		},
+		{"line of 64 KiB", long[:maxLogLineBytes-1] + "\n", 0, []string{long[:maxLogLineBytes-1]}, false},
+		{"under max size", "ab\ncd\n", 7, []string{"ab", "cd"}, false},
+		{"exactly max size", "ab\ncd\n", 6, []string{"ab", "cd"}, false},
+		{"exactly max size without final newline", "ab\ncd", 5, []string{"ab", "cd"}, false},
+		{"over max size", "ab\ncd\nef\n", 6, []string{"ab", "cd"}, true},
+		{"max size within a line", "ab\ncd\nef\n", 4, []string{"ab", "c" + lineTruncatedMarker}, true},
+		{"line over max size", long + "\nnext\n", 10, []string{long[:10] + lineTruncatedMarker}, true},
+		{"line over 64 KiB and max size", long + "\n", maxLogLineBytes + 10, []string{long[:maxLogLineBytes] + lineTruncatedMarker}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newLogScanner(strings.NewReader(tt.log), tt.maxBytes)
+			var got []string
+			for s.scan() {
+				got = append(got, s.text())
+			}
+			if s.err != nil {
+				t.Fatalf("scan() error = %v", s.err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("lines = %q, want %q", got, tt.want)
+			}
+			if s.truncated != tt.wantTruncated {
+				t.Errorf("truncated = %v, want %v", s.truncated, tt.wantTruncated)
+			}
+		})
+	}
+}
+
+// endlessLine is a log made of a single line that never ends
+type endlessLine struct {
+	read int64
+}
+
+func (r *endlessLine) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 'x'
+	}
+	r.read += int64(len(p))
+	return len(p), nil
+}
+
+func TestLogScannerEndlessLine(t *testing.T) {
+	const maxBytes = 1 << 20
+	r := &endlessLine{}
+	s := newLogScanner(r, maxBytes)
+	var lines int
+	for s.scan() {
+		lines++
+	}
+	if lines != 1 || !s.truncated {
+		t.Errorf("lines = %d, truncated = %v, want 1 truncated line", lines, s.truncated)
+	}
+	// Only a byte past the maximum size is read, to tell that the log goes on
+	if s.read != maxBytes || r.read != maxBytes+1 {
+		t.Errorf("read %d bytes of the log and %d from the reader, want %d and %d", s.read, r.read, maxBytes, maxBytes+1)
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Fields a job log line is labelled with. Each is either sent as a Loki stream
+// label or as structured metadata of the line.
+const (
+	logFieldRepoOwner    = "repo_owner"
+	logFieldRepoName     = "repo_name"
+	logFieldWorkflowName = "workflow_name"
+	logFieldWorkflowID   = "workflow_id"
+	logFieldJobName      = "workflow_job_name"
+	logFieldJobID        = "workflow_job_id"
+	logFieldTraceID      = "trace_id"
+	logFieldSpanID       = "span_id"
+	logFieldStepNumber   = "step_number"
+	logFieldLevel        = "level"
+	logFieldCodeFile     = "code_filepath"
+	logFieldCodeLine     = "code_lineno"
+	logFieldCodeColumn   = "code_column"
+)
+
+// logFields are all the fields a job log line may be labelled with
+var logFields = []string{
+	logFieldRepoOwner,
+	logFieldRepoName,
+	logFieldWorkflowName,
+	logFieldWorkflowID,
+	logFieldJobName,
+	logFieldJobID,
+	logFieldTraceID,
+	logFieldSpanID,
+	logFieldStepNumber,
+	logFieldLevel,
+	logFieldCodeFile,
+	logFieldCodeLine,
+	logFieldCodeColumn,
+}
+
+const (
+	// lokiMaxBatchBytes is the size of the log lines pushed to Loki in one request
+	lokiMaxBatchBytes = 1 << 20
+	// lokiPushTimeout bounds a single push request
+	lokiPushTimeout = 30 * time.Second
+)
+
+// lokiPushRetry controls how a push that failed with a server error is retried
+var lokiPushRetry = retryPolicy{maxAttempts: 3, baseDelay: time.Second, maxDelay: 10 * time.Second}
+
+// lokiPusher pushes job logs to the Loki push API. It uses the JSON format,
+// which carries structured metadata, so that only the fields with few values
+// are stream labels and the IDs that are unique to a run, job or step do not
+// create a stream each.
+type lokiPusher struct {
+	endpoint   string
+	authHeader string
+	client     *http.Client
+	// labels are the fields sent as stream labels, all others are sent as
+	// structured metadata
+	labels []string
+}
+
+// newLokiPusher creates a pusher for the given push endpoint. authHeader is
+// sent as a bearer token if it is not empty.
+func newLokiPusher(endpoint, authHeader string, labels []string) (*lokiPusher, error) {
+	p := &lokiPusher{
+		endpoint:   endpoint,
+		authHeader: authHeader,
+		client:     &http.Client{Timeout: lokiPushTimeout},
+	}
+	for _, label := range labels {
+		if label == "" {
+			continue
+		}
+		if !slices.Contains(logFields, label) {
+			return nil, fmt.Errorf("invalid log label %q, must be one of %s", label, strings.Join(logFields, ", "))
+		}
+		p.labels = append(p.labels, label)
+	}
+	if len(p.labels) == 0 {
+		return nil, errors.New("at least one log label is required")
+	}
+	return p, nil
+}
+
+// lokiStream is a stream of the Loki push API
+type lokiStream struct {
+	Stream map[string]string `json:"stream"`
+	// Values are the timestamp, line and, if any, structured metadata of each entry
+	Values [][]any `json:"values"`
+}
+
+// lokiBatch accumulates log lines until they are pushed to Loki
+type lokiBatch struct {
+	pusher  *lokiPusher
+	streams map[string]*lokiStream
+	lines   int
+	size    int
+}
+
+// newBatch starts a batch of log lines
+func (p *lokiPusher) newBatch() *lokiBatch {
+	return &lokiBatch{pusher: p, streams: map[string]*lokiStream{}}
+}
+
+// add adds a log line labelled with fields to the batch, and pushes the batch
+// once it is full
+func (b *lokiBatch) add(ctx context.Context, fields map[string]string, ts time.Time, line string) error {
+	labels := make(map[string]string, len(b.pusher.labels))
+	var key strings.Builder
+	for _, label := range b.pusher.labels {
+		if v, ok := fields[label]; ok {
+			labels[label] = v
+			key.WriteString(label + "=" + strconv.Quote(v) + ",")
+		}
+	}
+	metadata := map[string]string{}
+	for field, v := range fields {
+		if _, ok := labels[field]; !ok {
+			metadata[field] = v
+		}
+	}
+
+	stream, ok := b.streams[key.String()]
+	if !ok {
+		stream = &lokiStream{Stream: labels}
+		b.streams[key.String()] = stream
+	}
+	timestamp := strconv.FormatInt(ts.UnixNano(), 10)
+	value := []any{timestamp, line}
+	if len(metadata) > 0 {
+		value = append(value, metadata)
+	}
+	stream.Values = append(stream.Values, value)
+	b.lines++
+	// Count everything sent for the line, structured metadata can be as large
+	// as the line itself
+	b.size += len(timestamp) + len(line)
+	for field, v := range metadata {
+		b.size += len(field) + len(v)
+	}
+	if b.size >= lokiMaxBatchBytes {
+		return b.flush(ctx)
+	}
+	return nil
+}
+
+// flush pushes the lines in the batch to Loki and empties it. Lines that could
+// not be pushed are counted as dropped.
+func (b *lokiBatch) flush(ctx context.Context) error {
+	if b.lines == 0 {
+		return nil
+	}
+	lines := b.lines
+	streams := make([]*lokiStream, 0, len(b.streams))
+	for _, stream := range b.streams {
+		streams = append(streams, stream)
+	}
+	b.streams, b.lines, b.size = map[string]*lokiStream{}, 0, 0
+
+	body, err := json.Marshal(map[string]any{"streams": streams})
+	if err != nil {
+		lokiLinesDropped.Add(float64(lines))
+		return fmt.Errorf("error encoding log lines for loki: %w", err)
+	}
+	if err := b.pusher.pushWithRetry(ctx, body); err != nil {
+		lokiLinesDropped.Add(float64(lines))
+		return fmt.Errorf("error pushing log lines to loki: %w", err)
+	}
+	lokiLinesPushed.Add(float64(lines))
+	return nil
+}
+
+// pushWithRetry sends an encoded push request to Loki, retrying it while Loki
+// is unavailable or rate limits the push
+func (p *lokiPusher) pushWithRetry(ctx context.Context, body []byte) error {
+	for attempt := 1; ; attempt++ {
+		err := p.push(ctx, body)
+		var statusErr *lokiStatusError
+		if err == nil || attempt == lokiPushRetry.maxAttempts || (errors.As(err, &statusErr) && !statusErr.retryable()) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(lokiPushRetry.delay(attempt, err)):
+		}
+	}
+}
+
+// lokiStatusError is returned when Loki rejects a push
+type lokiStatusError struct {
+	status  int
+	message string
+}
+
+func (e *lokiStatusError) Error() string {
+	return fmt.Sprintf("loki responded with status %d: %s", e.status, e.message)
+}
+
+// retryable reports whether the push may succeed if it is sent again
+func (e *lokiStatusError) retryable() bool {
+	return e.status == http.StatusTooManyRequests || e.status >= http.StatusInternalServerError
+}
+
+// lokiUnavailable reports whether a push failed because Loki could not be
+// reached or kept failing after retries, rather than because it rejected the
+// entries of the push, e.g. for being too old or too long
+func lokiUnavailable(err error) bool {
+	var statusErr *lokiStatusError
+	return !errors.As(err, &statusErr) || statusErr.retryable()
+}
+
+// push sends an encoded push request to Loki
+func (p *lokiPusher) push(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if p.authHeader != "" {
+		req.Header.Set("Authorization", "Bearer "+p.authHeader)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return &lokiStatusError{status: resp.StatusCode, message: strings.TrimSpace(string(message))}
+	}
+	return nil
+}
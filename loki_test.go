@@ -0,0 +1,31 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestLokiUnavailable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"entry too far behind", &lokiStatusError{status: http.StatusBadRequest, message: "entry too far behind"}, false},
+		{"line too long", fmt.Errorf("error pushing log lines to loki: %w", &lokiStatusError{status: http.StatusBadRequest}), false},
+		{"rate limited", &lokiStatusError{status: http.StatusTooManyRequests}, true},
+		{"server error", &lokiStatusError{status: http.StatusServiceUnavailable}, true},
+		{"timeout", fmt.Errorf("error pushing log lines to loki: %w", context.DeadlineExceeded), true},
+		{"connection refused", errors.New("dial tcp: connection refused"), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := lokiUnavailable(tt.err); got != tt.want {
+				t.Errorf("lokiUnavailable(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
@@ -2,10 +2,13 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
+	"slices"
 	"syscall"
 	"time"
 
@@ -17,6 +20,7 @@ const (
 	serviceName         = "github-actions-otel-exporter"
 	serviceVersion      = "0.0.1"
 	httpShutdownTimeout = time.Second * 5
+	otelShutdownTimeout = time.Second * 10
 )
 
 type Config struct {
@@ -37,8 +41,120 @@ type Config struct {
 	LogEndpoint string `envconfig:"LOG_ENDPOINT" default:"http://localhost:3100/loki/api/v1/push"`
 	// LogAuthHeader is the auth header to use when sending logs
 	LogAuthHeader string `envconfig:"LOG_AUTH_HEADER" default:""`
+	// LogLabels is the comma separated list of fields sent as Loki stream
+	// labels, out of repo_owner, repo_name, workflow_name, workflow_id,
+	// workflow_job_name, workflow_job_id, trace_id, span_id and step_number. The
+	// other fields are sent as structured metadata, which requires Loki 2.9 or
+	// later with structured metadata allowed. Fields with many values, such as
+	// the IDs, create a stream each when sent as labels.
+	LogLabels []string `envconfig:"LOG_LABELS" default:"repo_owner,repo_name,workflow_name"`
+	// LogMaxBytes is the size of a job's log after which the rest of it is
+	// dropped, with a line marking the log as truncated. 0 disables the limit.
+	LogMaxBytes int64 `envconfig:"LOG_MAX_BYTES" default:"104857600"`
+	// LogExporter selects where job logs are sent: "loki" pushes them to
+	// LogEndpoint, "otlp" exports them as OTLP log records to the same collector
+	// as traces and metrics, and "both" does both.
+	LogExporter string `envconfig:"LOG_EXPORTER" default:"loki"`
 	// OTELInsecure is whether to use an insecure connection to the OTEL collector
 	OTELInsecure bool `envconfig:"OTEL_INSECURE" default:"false"`
+	// WebhookSecrets is a comma separated list of secrets used to verify the
+	// X-Hub-Signature-256 header of incoming webhooks. A delivery is accepted if it
+	// was signed with any of them, which allows secrets to be rotated without downtime.
+	// At least one secret is required unless WebhookInsecure is set.
+	WebhookSecrets []string `envconfig:"WEBHOOK_SECRETS" default:""`
+	// WebhookInsecure accepts unsigned webhooks when no secret is configured.
+	// Anyone who can reach the exporter can then make it call the GitHub API,
+	// so only use it for local development.
+	WebhookInsecure bool `envconfig:"WEBHOOK_INSECURE" default:"false"`
+	// DataDir is the directory used to persist the work queue across restarts
+	DataDir string `envconfig:"DATA_DIR" default:"data"`
+	// Workers is the number of workflow runs traced concurrently
+	Workers int `envconfig:"WORKERS" default:"4"`
+	// QueueSize is the maximum number of workflow runs waiting to be traced.
+	// Webhooks received while the queue is full are rejected so GitHub reports
+	// the delivery as failed and it can be redelivered later.
+	QueueSize int `envconfig:"QUEUE_SIZE" default:"1000"`
+	// MaxAttempts is the number of times a workflow run is traced before it is
+	// moved to the dead letter store
+	MaxAttempts int `envconfig:"MAX_ATTEMPTS" default:"5"`
+	// RetryBaseDelay is the delay before a failed workflow run is retried for
+	// the first time. It doubles with every attempt up to RetryMaxDelay.
+	RetryBaseDelay time.Duration `envconfig:"RETRY_BASE_DELAY" default:"30s"`
+	// RetryMaxDelay is the maximum delay between two attempts of a workflow run
+	RetryMaxDelay time.Duration `envconfig:"RETRY_MAX_DELAY" default:"30m"`
+	// StateRetention is how long the exporter remembers which run attempts it
+	// traced. Attempts of a run that is re-run after that are traced again.
+	// Jobs exported from workflow_job events of runs that never complete are
+	// forgotten after it as well.
+	StateRetention time.Duration `envconfig:"STATE_RETENTION" default:"720h"`
+	// AdminToken is the bearer token required by the /admin endpoints used to
+	// inspect and re-drive dead-lettered workflow runs. If empty, the admin
+	// endpoints are disabled.
+	AdminToken string `envconfig:"ADMIN_TOKEN" default:""`
+	// AttributeMode selects the span attribute keys that are emitted: "legacy" for
+	// the original github.* keys, "semconv" for the OpenTelemetry CI/CD and VCS
+	// semantic conventions, or "both" while migrating from one to the other.
+	AttributeMode string `envconfig:"ATTRIBUTE_MODE" default:"both"`
+	// TriggerMode selects how runs triggered by the workflow_run event are
+	// connected to the run that triggered them: "parent" exports them in the
+	// trace of that run, "link" adds span links in both directions and "none"
+	// leaves them unconnected.
+	TriggerMode string `envconfig:"TRIGGER_MODE" default:"link"`
+	// MetricDimensions is the comma separated list of dimensions CI metrics are
+	// broken down by, out of repository, workflow, branch, event, job, step,
+	// runner_labels, runner_group and conclusion. Leave out dimensions with many
+	// values, such as branch, to keep the number of series down.
+	MetricDimensions []string `envconfig:"METRIC_DIMENSIONS" default:"repository,workflow,event,job,step,runner_labels,conclusion"`
+	// ReceiverEnabled enables the OTLP receiver that workflow steps can send
+	// spans to. Received spans are exported under the span of the step that sent
+	// them once the run is traced. OTLP/HTTP is served on /v1/traces.
+	ReceiverEnabled bool `envconfig:"RECEIVER_ENABLED" default:"false"`
+	// ReceiverGRPCAddress is the address to serve OTLP/gRPC on. If empty, only
+	// OTLP/HTTP is served.
+	ReceiverGRPCAddress string `envconfig:"RECEIVER_GRPC_ADDRESS" default:""`
+	// ReceiverToken is the bearer token required to send spans to the receiver
+	// and to look up a job's traceparent. It is required if the receiver is
+	// enabled, since the lookups call the GitHub API.
+	ReceiverToken string `envconfig:"RECEIVER_TOKEN" default:""`
+	// ReceiverMaxSpans is the maximum number of received spans buffered while
+	// waiting for their run to be traced
+	ReceiverMaxSpans int `envconfig:"RECEIVER_MAX_SPANS" default:"100000"`
+	// ReceiverRetention is how long received spans are buffered before they are
+	// dropped if their run is never traced
+	ReceiverRetention time.Duration `envconfig:"RECEIVER_RETENTION" default:"24h"`
+	// SelfTracing enables tracing of the exporter's own handling of webhook
+	// deliveries: receipt, queue wait, GitHub API calls, log downloads and Loki
+	// pushes. These traces link to the CI traces they produced.
+	SelfTracing bool `envconfig:"SELF_TRACING" default:"false"`
+	// SelfTracingServiceName is the service.name of the exporter's own traces,
+	// kept apart from the CI traces
+	SelfTracingServiceName string `envconfig:"SELF_TRACING_SERVICE_NAME" default:"github-actions-otel-exporter-self"`
+}
+
+// validate checks the settings that envconfig cannot check by itself
+func (c Config) validate() error {
+	for _, setting := range []struct {
+		name  string
+		value int
+	}{
+		{"WORKERS", c.Workers},
+		{"QUEUE_SIZE", c.QueueSize},
+		{"MAX_ATTEMPTS", c.MaxAttempts},
+	} {
+		if setting.value < 1 {
+			return fmt.Errorf("%s must be at least 1, got %d", setting.name, setting.value)
+		}
+	}
+	if c.RetryBaseDelay <= 0 || c.RetryMaxDelay <= 0 {
+		return fmt.Errorf("RETRY_BASE_DELAY and RETRY_MAX_DELAY must be positive, got %s and %s", c.RetryBaseDelay, c.RetryMaxDelay)
+	}
+	if !c.WebhookInsecure && !slices.ContainsFunc(c.WebhookSecrets, func(secret string) bool { return secret != "" }) {
+		return errors.New("WEBHOOK_SECRETS is required, set WEBHOOK_INSECURE to accept unsigned webhooks")
+	}
+	if c.ReceiverEnabled && c.ReceiverToken == "" {
+		return errors.New("RECEIVER_TOKEN is required when RECEIVER_ENABLED is set")
+	}
+	return nil
 }
 
 func main() {
@@ -48,6 +164,10 @@ func main() {
 		slog.Error("failed to process env vars", "error", err)
 		os.Exit(1)
 	}
+	if err := conf.validate(); err != nil {
+		slog.Error("failed to process env vars", "error", err)
+		os.Exit(1)
+	}
 
 	gin.SetMode(gin.ReleaseMode)
 	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
@@ -58,12 +178,29 @@ func main() {
 	defer cancel()
 
 	// Setup OTEL exporter
-	shutdown, err := setupOTelSDK(ctx, serviceName, serviceVersion, conf.OTELInsecure)
+	logExporter, err := parseLogExporter(conf.LogExporter)
+	if err != nil {
+		slog.Error("failed to process env vars", "error", err)
+		os.Exit(1)
+	}
+	selfServiceName := ""
+	if conf.SelfTracing {
+		selfServiceName = conf.SelfTracingServiceName
+	}
+	shutdown, flush, err := setupOTelSDK(ctx, serviceName, serviceVersion, selfServiceName, conf.OTELInsecure, logExporter.otlp())
 	if err != nil {
 		slog.Error("failed to setup OTEL SDK", "error", err)
 		os.Exit(1)
 	}
-	defer shutdown(ctx)
+	defer func() {
+		// The signal context is cancelled by now, give the exporters their own
+		// time to send what is left
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), otelShutdownTimeout)
+		defer cancel()
+		if err := shutdown(shutdownCtx); err != nil {
+			slog.Error("unable to shutdown opentelemetry", "error", err)
+		}
+	}()
 
 	// Setup GitHub client
 	ghclient, err := getGithubClient(
@@ -78,24 +215,39 @@ func main() {
 	}
 
 	// Setup API
-	api, err := NewAPI(ctx, ghclient, conf.LogEndpoint, conf.LogAuthHeader)
+	api, err := NewAPI(ctx, ghclient, conf, flush)
 	if err != nil {
 		slog.Error("failed to setup api", "error", err)
 		os.Exit(1)
 	}
-	// Start the backend tracer queue
-	go api.ght.run()
+	// Start the backend tracer workers
+	api.ght.start(conf.Workers)
+	// Start the receiver for spans sent by workflow steps
+	if api.ght.receiver != nil {
+		if err := api.ght.receiver.start(ctx, conf.ReceiverGRPCAddress); err != nil {
+			slog.Error("failed to start otlp receiver", "error", err)
+			os.Exit(1)
+		}
+	}
 
 	// Start the server
 	server := &http.Server{
 		Addr:    conf.Address,
 		Handler: api.Router,
 	}
-	go gracefulShutdown(ctx, server, api)
+	shutdownDone := make(chan struct{})
+	go func() {
+		defer close(shutdownDone)
+		gracefulShutdown(ctx, server, api)
+	}()
 	slog.Info("starting server", "addr", server.Addr)
 	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 		slog.Error("failed to start server", "error", err)
+		cancel()
 	}
+	// ListenAndServe returns as soon as shutdown starts, wait for the tracer
+	// to finish and the store to be closed before exiting
+	<-shutdownDone
 }
 
 //nolint:contextcheck
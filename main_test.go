@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestConfigValidate(t *testing.T) {
+	valid := func() Config {
+		return Config{
+			WebhookSecrets: []string{"secret"},
+			Workers:        4,
+			QueueSize:      1000,
+			MaxAttempts:    5,
+			RetryBaseDelay: 30 * time.Second,
+			RetryMaxDelay:  30 * time.Minute,
+		}
+	}
+	tests := []struct {
+		name    string
+		modify  func(c *Config)
+		wantErr bool
+	}{
+		{"defaults", func(c *Config) {}, false},
+		{"no webhook secret", func(c *Config) { c.WebhookSecrets = nil }, true},
+		{"empty webhook secret", func(c *Config) { c.WebhookSecrets = []string{""} }, true},
+		{"insecure webhooks", func(c *Config) { c.WebhookSecrets, c.WebhookInsecure = nil, true }, false},
+		{"no workers", func(c *Config) { c.Workers = 0 }, true},
+		{"no queue", func(c *Config) { c.QueueSize = 0 }, true},
+		{"negative attempts", func(c *Config) { c.MaxAttempts = -1 }, true},
+		{"negative retry delay", func(c *Config) { c.RetryBaseDelay = -time.Second }, true},
+		{"zero max retry delay", func(c *Config) { c.RetryMaxDelay = 0 }, true},
+		{"receiver without token", func(c *Config) { c.ReceiverEnabled = true }, true},
+		{"receiver with token", func(c *Config) { c.ReceiverEnabled, c.ReceiverToken = true, "token" }, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := valid()
+			tt.modify(&c)
+			if err := c.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
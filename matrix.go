@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/google/go-github/v58/github"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"gopkg.in/yaml.v3"
+)
+
+// matrixGroup is the set of jobs of a run attempt created from one matrix
+type matrixGroup struct {
+	// id is the ID of the job definition with the matrix
+	id string
+	// name is the name of the jobs without their matrix values
+	name string
+	// dimensions are the matrix keys, in the order GitHub lists their values in job names
+	dimensions []string
+	jobs       []*github.WorkflowJob
+}
+
+// hasMatrix reports whether a job definition uses a matrix strategy
+func (def *workflowJobDefinition) hasMatrix() bool {
+	return def != nil && !def.Strategy.Matrix.IsZero()
+}
+
+// matrixDimensions returns the keys of a job definition's matrix. Keys that only
+// appear in include entries come last. Matrices built from expressions have no
+// known dimensions.
+func (def *workflowJobDefinition) matrixDimensions() []string {
+	matrix := def.Strategy.Matrix
+	if matrix.Kind != yaml.MappingNode {
+		return nil
+	}
+	var dimensions, included []string
+	for i := 0; i+1 < len(matrix.Content); i += 2 {
+		switch key, value := matrix.Content[i].Value, matrix.Content[i+1]; key {
+		case "exclude":
+		case "include":
+			if value.Kind != yaml.SequenceNode {
+				continue
+			}
+			for _, entry := range value.Content {
+				if entry.Kind != yaml.MappingNode {
+					continue
+				}
+				for j := 0; j < len(entry.Content); j += 2 {
+					included = append(included, entry.Content[j].Value)
+				}
+			}
+		default:
+			dimensions = append(dimensions, key)
+		}
+	}
+	for _, key := range included {
+		if !slices.Contains(dimensions, key) {
+			dimensions = append(dimensions, key)
+		}
+	}
+	return dimensions
+}
+
+// matrixGroups groups the jobs of a run attempt by the matrix they were created
+// from. Without a workflow definition, jobs are grouped by name instead, which
+// requires at least two jobs with the same name and different matrix values.
+func matrixGroups(wd *workflowDefinition, jobs []*github.WorkflowJob) []*matrixGroup {
+	var groups []*matrixGroup
+	byID := map[string]*matrixGroup{}
+	for _, job := range jobs {
+		name, values := splitMatrixValues(job.GetName())
+		id := name
+		if wd != nil {
+			defID, ok := wd.jobID(job.GetName())
+			if !ok || !wd.Jobs[defID].hasMatrix() {
+				continue
+			}
+			id = defID
+			// Jobs with a custom name do not list their matrix values
+			if values == nil {
+				name = defID
+			}
+		} else if values == nil {
+			continue
+		}
+		group, ok := byID[id]
+		if !ok {
+			group = &matrixGroup{id: id, name: name}
+			if wd != nil {
+				group.dimensions = wd.Jobs[id].matrixDimensions()
+			}
+			byID[id] = group
+			groups = append(groups, group)
+		}
+		group.jobs = append(group.jobs, job)
+	}
+	if wd != nil {
+		return groups
+	}
+	grouped := groups[:0]
+	for _, group := range groups {
+		if len(group.jobs) > 1 {
+			grouped = append(grouped, group)
+		}
+	}
+	return grouped
+}
+
+// callerName returns the name of a job without the name of the job it calls
+// in a reusable workflow, if any
+func callerName(name string) string {
+	caller, _, _ := strings.Cut(name, " / ")
+	return caller
+}
+
+// splitMatrixValues splits the matrix values GitHub appends to the name of a
+// job created from a matrix, e.g. "test (ubuntu-latest, 1.21)", from its name
+func splitMatrixValues(name string) (string, []string) {
+	name = callerName(name)
+	m := matrixSuffix.FindStringSubmatch(name)
+	if m == nil {
+		return name, nil
+	}
+	return m[1], strings.Split(m[2], ", ")
+}
+
+// jobAttributes returns the matrix values of a job in the group. GitHub leaves
+// out the values of include keys that do not apply to a job, so values are
+// mapped onto dimensions by position as long as there are not more of them.
+// Jobs that are not in a group, including jobs that are only named like
+// matrix jobs, have no matrix values.
+func (g *matrixGroup) jobAttributes(job *github.WorkflowJob) []attribute.KeyValue {
+	if g == nil {
+		return nil
+	}
+	_, values := splitMatrixValues(job.GetName())
+	if len(values) == 0 {
+		return nil
+	}
+	kvs := []attribute.KeyValue{attribute.StringSlice("github.job.matrix.values", values)}
+	if len(values) <= len(g.dimensions) {
+		for i, value := range values {
+			kvs = append(kvs, attribute.String("github.job.matrix."+g.dimensions[i], value))
+		}
+	}
+	return kvs
+}
+
+// traceMatrix exports the span grouping the jobs of a matrix and returns the
+// context their spans are started in
+func (ght *GitHubTracer) traceMatrix(workflowCtx context.Context, group *matrixGroup) context.Context {
+	start, end := groupTimes(group.jobs)
+	failedJobs := countFailed(group.jobs)
+	matrixCtx, matrixSpan := startSpan(
+		workflowCtx,
+		matrixSpanKey(group.id),
+		group.name,
+		trace.WithTimestamp(start),
+		trace.WithAttributes(
+			attribute.String("github.matrix.id", group.id),
+			attribute.StringSlice("github.matrix.dimensions", group.dimensions),
+			attribute.Int("github.matrix.job_count", len(group.jobs)),
+			attribute.Int("github.matrix.failed_count", failedJobs),
+		),
+	)
+	if failedJobs > 0 {
+		matrixSpan.SetStatus(codes.Error, fmt.Sprintf("%d of %d matrix jobs failed", failedJobs, len(group.jobs)))
+	}
+	// The span's times are already known, so it can be ended before its jobs
+	matrixSpan.End(trace.WithTimestamp(end))
+	return matrixCtx
+}
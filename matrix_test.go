@@ -0,0 +1,74 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/google/go-github/v58/github"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+func TestMatrixJobAttributes(t *testing.T) {
+	tests := []struct {
+		name  string
+		group *matrixGroup
+		job   string
+		want  []attribute.KeyValue
+	}{
+		{"not in a matrix", nil, "x (y)", nil},
+		{"without values", &matrixGroup{id: "build"}, "build", nil},
+		{
+			"without dimensions",
+			&matrixGroup{id: "test"},
+			"test (linux, 1.21)",
+			[]attribute.KeyValue{attribute.StringSlice("github.job.matrix.values", []string{"linux", "1.21"})},
+		},
+		{
+			"with dimensions",
+			&matrixGroup{id: "test", dimensions: []string{"os", "go"}},
+			"test (linux, 1.21)",
+			[]attribute.KeyValue{
+				attribute.StringSlice("github.job.matrix.values", []string{"linux", "1.21"}),
+				attribute.String("github.job.matrix.os", "linux"),
+				attribute.String("github.job.matrix.go", "1.21"),
+			},
+		},
+		{
+			"more values than dimensions",
+			&matrixGroup{id: "test", dimensions: []string{"os"}},
+			"test (linux, 1.21)",
+			[]attribute.KeyValue{attribute.StringSlice("github.job.matrix.values", []string{"linux", "1.21"})},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.group.jobAttributes(&github.WorkflowJob{Name: github.String(tt.job)})
+			if len(got) != len(tt.want) {
+				t.Fatalf("jobAttributes() = %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i].Key != tt.want[i].Key || got[i].Value.Emit() != tt.want[i].Value.Emit() {
+					t.Errorf("jobAttributes()[%d] = %v, want %v", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestMatrixGroupsWithoutDefinition(t *testing.T) {
+	job := func(id int64, name string) *github.WorkflowJob {
+		return &github.WorkflowJob{ID: github.Int64(id), Name: github.String(name)}
+	}
+	jobs := []*github.WorkflowJob{
+		job(1, "x (y)"),
+		job(2, "test (linux)"),
+		job(3, "test (windows)"),
+		job(4, "lint"),
+	}
+	groups := matrixGroups(nil, jobs)
+	if len(groups) != 1 {
+		t.Fatalf("matrixGroups() returned %d groups, want 1", len(groups))
+	}
+	if groups[0].name != "test" || len(groups[0].jobs) != 2 {
+		t.Errorf("matrixGroups() = %s with %d jobs, want test with 2 jobs", groups[0].name, len(groups[0].jobs))
+	}
+}
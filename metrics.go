@@ -0,0 +1,124 @@
+package main
+
+import (
+	"slices"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	// metricsNamespace prefixes all of the exporter's internal metrics
+	metricsNamespace = "gha_exporter"
+)
+
+var (
+	// webhooksReceived counts the webhook deliveries received, by event type
+	webhooksReceived = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "webhooks_received_total",
+		Help:      "Number of webhook deliveries received by the exporter.",
+	}, []string{"event"})
+
+	// webhooksRejected counts the webhook deliveries we refused to process
+	webhooksRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "webhooks_rejected_total",
+		Help:      "Number of webhook deliveries rejected by the exporter.",
+	}, []string{"event", "reason"})
+
+	// queueDepth is the number of items waiting in the work queue
+	queueDepth = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "queue_depth",
+		Help:      "Number of workflow runs waiting in the work queue.",
+	})
+
+	// workersInFlight is the number of items currently being processed
+	workersInFlight = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "workers_in_flight",
+		Help:      "Number of workflow runs currently being traced.",
+	})
+
+	// queueWait is the time items spent in the work queue before a worker
+	// picked them up, not counting retry delays
+	queueWait = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "queue_wait_seconds",
+		Help:      "Time workflow events waited in the work queue.",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 4, 10),
+	})
+
+	// eventsTraced counts the workflow events traced successfully
+	eventsTraced = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "workflow_events_traced_total",
+		Help:      "Number of workflow run and job events traced.",
+	}, []string{"event"})
+
+	// eventsFailed counts the attempts at tracing workflow events that failed,
+	// by whether the event was retried or dead-lettered
+	eventsFailed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "workflow_events_failed_total",
+		Help:      "Number of failed attempts at tracing workflow run and job events.",
+	}, []string{"event", "outcome"})
+
+	// githubRequests counts the requests made to the GitHub API
+	githubRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "github_requests_total",
+		Help:      "Number of requests made to the GitHub API.",
+	}, []string{"endpoint", "status"})
+
+	// githubRequestDuration is the latency of requests made to the GitHub API
+	githubRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "github_request_duration_seconds",
+		Help:      "Latency of requests made to the GitHub API.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"endpoint"})
+
+	// githubRateLimitRemaining is the number of requests left in the current
+	// rate limit window, as reported by the last response
+	githubRateLimitRemaining = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "github_rate_limit_remaining",
+		Help:      "Number of GitHub API requests remaining in the current rate limit window.",
+	}, []string{"resource"})
+
+	// lokiLinesPushed counts the log lines Loki accepted
+	lokiLinesPushed = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "loki_lines_pushed_total",
+		Help:      "Number of workflow log lines pushed to Loki.",
+	})
+
+	// lokiLinesDropped counts the log lines that could not be pushed to Loki
+	lokiLinesDropped = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "loki_lines_dropped_total",
+		Help:      "Number of workflow log lines that could not be pushed to Loki.",
+	})
+
+	// otlpExportFailures counts the batches of telemetry that failed to export
+	otlpExportFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "otlp_export_failures_total",
+		Help:      "Number of batches of traces, metrics and logs that failed to export over OTLP.",
+	})
+)
+
+// webhookEvents are the event types webhook metrics are labelled with. Other
+// values of the X-GitHub-Event header are reported as "other" so that senders
+// cannot create arbitrary series.
+var webhookEvents = []string{"workflow_run", "workflow_job", "ping"}
+
+// webhookEvent returns the event type label of a webhook delivery
+func webhookEvent(header string) string {
+	if slices.Contains(webhookEvents, header) {
+		return header
+	}
+	return "other"
+}
@@ -3,23 +3,32 @@ package main
 import (
 	"context"
 	"errors"
+	"log/slog"
 	"time"
 
 	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlplog/otlploggrpc"
 	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
 	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/log/global"
 	"go.opentelemetry.io/otel/propagation"
 
+	"go.opentelemetry.io/otel/sdk/log"
 	"go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
 	"go.opentelemetry.io/otel/sdk/resource"
 	"go.opentelemetry.io/otel/sdk/trace"
 	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
 )
 
-// setupOTelSDK bootstraps the OpenTelemetry pipeline.
+// setupOTelSDK bootstraps the OpenTelemetry pipeline. If selfServiceName is not
+// empty, the exporter's own handling of deliveries is traced under that service.
+// If logs is set, a logger provider exporting OTLP log records is set up as well.
 // If it does not return an error, make sure to call shutdown for proper cleanup.
-func setupOTelSDK(ctx context.Context, serviceName, serviceVersion string, insecure bool) (shutdown func(context.Context) error, err error) {
+// flush exports the CI spans and log records that are still buffered.
+func setupOTelSDK(ctx context.Context, serviceName, serviceVersion, selfServiceName string, insecure, logs bool) (shutdown, flush func(context.Context) error, err error) {
 	var shutdownFuncs []func(context.Context) error
+	var flushFuncs []func(context.Context) error
 
 	// shutdown calls cleanup functions registered via shutdownFuncs.
 	// The errors from the calls are joined.
@@ -33,6 +42,16 @@ func setupOTelSDK(ctx context.Context, serviceName, serviceVersion string, insec
 		return err
 	}
 
+	// flush calls the flush functions registered via flushFuncs.
+	// The errors from the calls are joined.
+	flush = func(ctx context.Context) error {
+		var err error
+		for _, fn := range flushFuncs {
+			err = errors.Join(err, fn(ctx))
+		}
+		return err
+	}
+
 	// handleErr calls shutdown for cleanup and makes sure that all errors are returned.
 	handleErr := func(inErr error) {
 		err = errors.Join(inErr, shutdown(ctx))
@@ -45,6 +64,12 @@ func setupOTelSDK(ctx context.Context, serviceName, serviceVersion string, insec
 		return
 	}
 
+	// Log the errors the SDK reports. Export failures are counted by the
+	// exporters themselves, since the SDK also reports warnings here.
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		slog.Error("opentelemetry error", "error", err)
+	}))
+
 	// Set up propagator.
 	prop := newPropagator()
 	otel.SetTextMapPropagator(prop)
@@ -56,6 +81,7 @@ func setupOTelSDK(ctx context.Context, serviceName, serviceVersion string, insec
 		return
 	}
 	shutdownFuncs = append(shutdownFuncs, tracerProvider.Shutdown)
+	flushFuncs = append(flushFuncs, tracerProvider.ForceFlush)
 	otel.SetTracerProvider(tracerProvider)
 
 	// Set up meter provider.
@@ -67,6 +93,37 @@ func setupOTelSDK(ctx context.Context, serviceName, serviceVersion string, insec
 	shutdownFuncs = append(shutdownFuncs, meterProvider.Shutdown)
 	otel.SetMeterProvider(meterProvider)
 
+	// Set up logger provider.
+	if logs {
+		var loggerProvider *log.LoggerProvider
+		loggerProvider, err = newLoggerProvider(res, insecure)
+		if err != nil {
+			handleErr(err)
+			return
+		}
+		shutdownFuncs = append(shutdownFuncs, loggerProvider.Shutdown)
+		flushFuncs = append(flushFuncs, loggerProvider.ForceFlush)
+		global.SetLoggerProvider(loggerProvider)
+	}
+
+	// Set up self trace provider.
+	if selfServiceName != "" {
+		var selfRes *resource.Resource
+		selfRes, err = newResource(selfServiceName, serviceVersion)
+		if err != nil {
+			handleErr(err)
+			return
+		}
+		var selfTracerProvider *trace.TracerProvider
+		selfTracerProvider, err = newSelfTraceProvider(selfRes, insecure)
+		if err != nil {
+			handleErr(err)
+			return
+		}
+		shutdownFuncs = append(shutdownFuncs, selfTracerProvider.Shutdown)
+		selfTracer = selfTracerProvider.Tracer(selfServiceName)
+	}
+
 	return
 }
 
@@ -97,14 +154,35 @@ func newTraceProvider(res *resource.Resource, insecure bool) (*trace.TracerProvi
 	}
 
 	traceProvider := trace.NewTracerProvider(
-		trace.WithBatcher(traceExporter,
+		trace.WithBatcher(countingSpanExporter{traceExporter},
 			// Default is 5s. Set to 1s for demonstrative purposes.
 			trace.WithBatchTimeout(time.Second)),
 		trace.WithResource(res),
+		// Derive trace and span IDs from the workflow run being traced
+		trace.WithIDGenerator(ciIDGenerator{}),
 	)
 	return traceProvider, nil
 }
 
+// newSelfTraceProvider creates the tracer provider for self-tracing. Unlike the
+// CI tracer provider, it uses random trace and span IDs.
+func newSelfTraceProvider(res *resource.Resource, insecure bool) (*trace.TracerProvider, error) {
+	ctx := context.Background()
+	opts := []otlptracegrpc.Option{}
+	if insecure {
+		opts = append(opts, otlptracegrpc.WithInsecure())
+	}
+	traceExporter, err := otlptracegrpc.New(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return trace.NewTracerProvider(
+		trace.WithBatcher(countingSpanExporter{traceExporter}),
+		trace.WithResource(res),
+	), nil
+}
+
 func newMeterProvider(res *resource.Resource, insecure bool) (*metric.MeterProvider, error) {
 	ctx := context.Background()
 	opts := []otlpmetricgrpc.Option{}
@@ -118,9 +196,66 @@ func newMeterProvider(res *resource.Resource, insecure bool) (*metric.MeterProvi
 
 	meterProvider := metric.NewMeterProvider(
 		metric.WithResource(res),
-		metric.WithReader(metric.NewPeriodicReader(metricExporter,
+		metric.WithReader(metric.NewPeriodicReader(countingMetricExporter{metricExporter},
 			// Default is 1m. Set to 3s for demonstrative purposes.
 			metric.WithInterval(3*time.Second))),
 	)
 	return meterProvider, nil
 }
+
+func newLoggerProvider(res *resource.Resource, insecure bool) (*log.LoggerProvider, error) {
+	ctx := context.Background()
+	opts := []otlploggrpc.Option{}
+	if insecure {
+		opts = append(opts, otlploggrpc.WithInsecure())
+	}
+	logExporter, err := otlploggrpc.New(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	loggerProvider := log.NewLoggerProvider(
+		log.WithResource(res),
+		log.WithProcessor(log.NewBatchProcessor(countingLogExporter{logExporter})),
+	)
+	return loggerProvider, nil
+}
+
+// countingSpanExporter counts the batches of spans that fail to export
+type countingSpanExporter struct {
+	trace.SpanExporter
+}
+
+func (e countingSpanExporter) ExportSpans(ctx context.Context, spans []trace.ReadOnlySpan) error {
+	err := e.SpanExporter.ExportSpans(ctx, spans)
+	if err != nil {
+		otlpExportFailures.Inc()
+	}
+	return err
+}
+
+// countingMetricExporter counts the collections of metrics that fail to export
+type countingMetricExporter struct {
+	metric.Exporter
+}
+
+func (e countingMetricExporter) Export(ctx context.Context, rm *metricdata.ResourceMetrics) error {
+	err := e.Exporter.Export(ctx, rm)
+	if err != nil {
+		otlpExportFailures.Inc()
+	}
+	return err
+}
+
+// countingLogExporter counts the batches of log records that fail to export
+type countingLogExporter struct {
+	log.Exporter
+}
+
+func (e countingLogExporter) Export(ctx context.Context, records []log.Record) error {
+	err := e.Exporter.Export(ctx, records)
+	if err != nil {
+		otlpExportFailures.Inc()
+	}
+	return err
+}
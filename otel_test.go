@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.opentelemetry.io/otel/sdk/trace"
+)
+
+// failingSpanExporter is a span exporter that returns err from every export
+type failingSpanExporter struct {
+	err error
+}
+
+func (e failingSpanExporter) ExportSpans(context.Context, []trace.ReadOnlySpan) error { return e.err }
+
+func (e failingSpanExporter) Shutdown(context.Context) error { return nil }
+
+func TestCountingSpanExporter(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want float64
+	}{
+		{"successful export", nil, 0},
+		{"failed export", errors.New("collector unavailable"), 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := testutil.ToFloat64(otlpExportFailures)
+			e := countingSpanExporter{failingSpanExporter{err: tt.err}}
+			if err := e.ExportSpans(context.Background(), nil); !errors.Is(err, tt.err) {
+				t.Errorf("ExportSpans() error = %v, want %v", err, tt.err)
+			}
+			if got := testutil.ToFloat64(otlpExportFailures) - before; got != tt.want {
+				t.Errorf("otlp_export_failures_total increased by %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
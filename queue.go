@@ -0,0 +1,264 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/google/go-github/v58/github"
+	bolt "go.etcd.io/bbolt"
+)
+
+// queueItem is a unit of work persisted in the workQueue
+type queueItem struct {
+	ID         uint64    `json:"id"`
+	EnqueuedAt time.Time `json:"enqueued_at"`
+	// Attempts is the number of times processing the item has failed
+	Attempts int `json:"attempts,omitempty"`
+	// LastError is the error returned by the last failed attempt
+	LastError string `json:"last_error,omitempty"`
+	// NotBefore delays processing of the item until the given time
+	NotBefore time.Time `json:"not_before,omitempty"`
+	// TraceContext carries the exporter's trace of the delivery when self-tracing is enabled
+	TraceContext map[string]string `json:"trace_context,omitempty"`
+	// Exactly one of Run or Job is set
+	Run *github.WorkflowRunEvent `json:"run,omitempty"`
+	Job *github.WorkflowJobEvent `json:"job,omitempty"`
+}
+
+// repo returns the full name of the repository the item belongs to
+func (item *queueItem) repo() string {
+	if item.Job != nil {
+		return item.Job.GetRepo().GetFullName()
+	}
+	return item.Run.GetRepo().GetFullName()
+}
+
+// runID returns the ID of the workflow run the item belongs to
+func (item *queueItem) runID() int64 {
+	if item.Job != nil {
+		return item.Job.GetWorkflowJob().GetRunID()
+	}
+	return item.Run.GetWorkflowRun().GetID()
+}
+
+// event returns the type of the webhook event carried by the item
+func (item *queueItem) event() string {
+	if item.Job != nil {
+		return "workflow_job"
+	}
+	return "workflow_run"
+}
+
+// readyAt returns the time the item became available to workers
+func (item *queueItem) readyAt() time.Time {
+	if item.NotBefore.After(item.EnqueuedAt) {
+		return item.NotBefore
+	}
+	return item.EnqueuedAt
+}
+
+// errQueueFull is returned by push when the queue has reached its capacity
+var errQueueFull = errors.New("work queue is full")
+
+// workQueue is a durable queue of workflow run and job events. Items are written
+// to disk before push returns and are only removed once they are acked, so any
+// work that was pending when the process stopped is replayed on startup.
+//
+// Items are handed out round-robin across repositories so that a burst of
+// runs in one busy repository cannot starve the others.
+type workQueue struct {
+	db   *bolt.DB
+	size int
+	mu   sync.Mutex
+	// pending holds the items waiting to be processed, keyed by repository
+	pending map[string][]*queueItem
+	// repos is the round-robin order of repositories with pending items
+	repos []string
+	depth int
+	// scheduled is the number of persisted items waiting for their retry delay
+	scheduled int
+	// reserved is the number of pushed items that are being persisted
+	reserved int
+	// ready is signalled whenever new items are pushed
+	ready chan struct{}
+}
+
+// newWorkQueue creates a workQueue backed by db that holds at most size
+// pending items, loading any items that were persisted but never acked.
+func newWorkQueue(db *bolt.DB, size int) (*workQueue, error) {
+	q := &workQueue{
+		db:      db,
+		size:    size,
+		pending: map[string][]*queueItem{},
+		ready:   make(chan struct{}, 1),
+	}
+	err := db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(queueBucket).ForEach(func(k, v []byte) error {
+			item := &queueItem{}
+			if err := json.Unmarshal(v, item); err != nil {
+				return fmt.Errorf("failed to decode queue item: %w", err)
+			}
+			if delay := time.Until(item.NotBefore); delay > 0 {
+				q.schedule(item, delay)
+				return nil
+			}
+			q.enqueue(item)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	if q.depth > 0 {
+		slog.Info("replaying persisted queue items", "count", q.depth)
+		q.signal()
+	}
+	return q, nil
+}
+
+// push persists a workflow run or job event and makes it available to pop.
+// It returns errQueueFull without persisting anything if the queue is at capacity.
+func (q *workQueue) push(item *queueItem) error {
+	// Reserve a slot so that concurrent pushes cannot overshoot the capacity
+	q.mu.Lock()
+	if q.depth+q.scheduled+q.reserved >= q.size {
+		q.mu.Unlock()
+		return errQueueFull
+	}
+	q.reserved++
+	q.mu.Unlock()
+
+	item.EnqueuedAt = time.Now()
+	err := q.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(queueBucket)
+		id, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		item.ID = id
+		buf, err := json.Marshal(item)
+		if err != nil {
+			return err
+		}
+		return b.Put(itob(id), buf)
+	})
+	q.mu.Lock()
+	q.reserved--
+	if err == nil {
+		q.enqueue(item)
+	}
+	q.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to persist queue item: %w", err)
+	}
+	q.signal()
+	return nil
+}
+
+// pop blocks until an item is available or quit is closed. Items
+// returned by pop stay persisted until they are acked.
+func (q *workQueue) pop(quit <-chan struct{}) (*queueItem, bool) {
+	for {
+		q.mu.Lock()
+		if q.depth > 0 {
+			item := q.dequeue()
+			remaining := q.depth
+			q.mu.Unlock()
+			// Wake up another worker if there is more work to do
+			if remaining > 0 {
+				q.signal()
+			}
+			return item, true
+		}
+		q.mu.Unlock()
+
+		select {
+		case <-quit:
+			return nil, false
+		case <-q.ready:
+		}
+	}
+}
+
+// ack removes a processed item from the store
+func (q *workQueue) ack(item *queueItem) error {
+	return q.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(queueBucket).Delete(itob(item.ID))
+	})
+}
+
+// retry persists the state of a failed item and makes it available to pop
+// again once delay has passed.
+func (q *workQueue) retry(item *queueItem, delay time.Duration) error {
+	item.NotBefore = time.Now().Add(delay)
+	err := q.db.Update(func(tx *bolt.Tx) error {
+		buf, err := json.Marshal(item)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(queueBucket).Put(itob(item.ID), buf)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to persist queue item: %w", err)
+	}
+	q.schedule(item, delay)
+	return nil
+}
+
+// schedule re-adds an item to the queue after delay. Retries bypass the
+// capacity check since the item is already persisted, but count towards it
+// while they wait so that the store stays bounded.
+func (q *workQueue) schedule(item *queueItem, delay time.Duration) {
+	q.mu.Lock()
+	q.scheduled++
+	q.mu.Unlock()
+	time.AfterFunc(delay, func() {
+		q.mu.Lock()
+		q.scheduled--
+		q.enqueue(item)
+		q.mu.Unlock()
+		q.signal()
+	})
+}
+
+// enqueue adds an item to the back of its repository's queue.
+// The caller must hold q.mu.
+func (q *workQueue) enqueue(item *queueItem) {
+	repo := item.repo()
+	if len(q.pending[repo]) == 0 {
+		q.repos = append(q.repos, repo)
+	}
+	q.pending[repo] = append(q.pending[repo], item)
+	q.depth++
+	queueDepth.Set(float64(q.depth))
+}
+
+// dequeue takes the next item from the repository at the front of the
+// round-robin order. The caller must hold q.mu and ensure q.depth > 0.
+func (q *workQueue) dequeue() *queueItem {
+	repo := q.repos[0]
+	q.repos = q.repos[1:]
+	items := q.pending[repo]
+	item := items[0]
+	if len(items) > 1 {
+		q.pending[repo] = items[1:]
+		q.repos = append(q.repos, repo)
+	} else {
+		delete(q.pending, repo)
+	}
+	q.depth--
+	queueDepth.Set(float64(q.depth))
+	return item
+}
+
+// signal wakes up a routine waiting in pop without blocking
+func (q *workQueue) signal() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
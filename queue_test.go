@@ -0,0 +1,62 @@
+package main
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/google/go-github/v58/github"
+)
+
+func TestWorkQueueRoundRobin(t *testing.T) {
+	tests := []struct {
+		name   string
+		pushed []string
+		want   []string
+	}{
+		{"single repository", []string{"a", "a", "a"}, []string{"a", "a", "a"}},
+		{"busy repository", []string{"a", "a", "a", "b", "c", "c"}, []string{"a", "b", "c", "a", "c", "a"}},
+		{"interleaved", []string{"a", "b", "a", "b"}, []string{"a", "b", "a", "b"}},
+		{"late repository", []string{"a", "a", "a", "a", "b"}, []string{"a", "b", "a", "a", "a"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, err := openStore(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { db.Close() })
+			q, err := newWorkQueue(db, len(tt.pushed))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, repo := range tt.pushed {
+				err := q.push(&queueItem{Run: &github.WorkflowRunEvent{
+					Repo: &github.Repository{FullName: github.String(repo)},
+				}})
+				if err != nil {
+					t.Fatalf("push() error = %v", err)
+				}
+			}
+			if err := q.push(&queueItem{Run: &github.WorkflowRunEvent{}}); err != errQueueFull {
+				t.Errorf("push() on a full queue error = %v, want %v", err, errQueueFull)
+			}
+
+			quit := make(chan struct{})
+			close(quit)
+			var got []string
+			for range tt.pushed {
+				item, ok := q.pop(quit)
+				if !ok {
+					t.Fatal("pop() returned no item")
+				}
+				got = append(got, item.repo())
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("pop() order = %v, want %v", got, tt.want)
+			}
+			if _, ok := q.pop(quit); ok {
+				t.Error("pop() returned an item from an empty queue")
+			}
+		})
+	}
+}
@@ -0,0 +1,500 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/go-github/v58/github"
+	bolt "go.etcd.io/bbolt"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/trace"
+	collectortrace "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// maxReceiveSize is the maximum size of an OTLP/HTTP request body
+	maxReceiveSize = 16 << 20
+	// sweepInterval is how often buffered spans are checked for expiry
+	sweepInterval = 10 * time.Minute
+)
+
+// errReceiverFull is returned when accepting spans would exceed the buffer size
+var errReceiverFull = errors.New("span buffer is full")
+
+// spanReceiver accepts spans that workflow steps send over OTLP and buffers
+// them until the run attempt they belong to is traced. The spans are then
+// re-parented under the span of the step that sent them and exported.
+//
+// Buffered spans are stored by trace ID as
+// <received at, 8 bytes><span count, 8 bytes><ResourceSpans protobuf>.
+type spanReceiver struct {
+	collectortrace.UnimplementedTraceServiceServer
+
+	db         *bolt.DB
+	client     otlptrace.Client
+	token      string
+	maxSpans   int64
+	retention  time.Duration
+	spans      atomic.Int64
+	grpcServer *grpc.Server
+	quit       chan struct{}
+}
+
+// newSpanReceiver creates a span receiver buffering spans in db, and counts the
+// spans already buffered
+func newSpanReceiver(db *bolt.DB, conf Config) (*spanReceiver, error) {
+	opts := []otlptracegrpc.Option{}
+	if conf.OTELInsecure {
+		opts = append(opts, otlptracegrpc.WithInsecure())
+	}
+	r := &spanReceiver{
+		db:        db,
+		client:    otlptracegrpc.NewClient(opts...),
+		token:     conf.ReceiverToken,
+		maxSpans:  int64(conf.ReceiverMaxSpans),
+		retention: conf.ReceiverRetention,
+		quit:      make(chan struct{}),
+	}
+	err := db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(spansBucket).ForEach(func(k, v []byte) error {
+			if len(v) >= 16 {
+				r.spans.Add(int64(btoi(v[8:16])))
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to count buffered spans: %w", err)
+	}
+	return r, nil
+}
+
+// start connects the exporter and starts serving OTLP/gRPC on grpcAddress, if set
+func (r *spanReceiver) start(ctx context.Context, grpcAddress string) error {
+	if err := r.client.Start(ctx); err != nil {
+		return fmt.Errorf("failed to start span receiver exporter: %w", err)
+	}
+	if grpcAddress != "" {
+		lis, err := net.Listen("tcp", grpcAddress)
+		if err != nil {
+			return fmt.Errorf("failed to listen for otlp/grpc: %w", err)
+		}
+		r.grpcServer = grpc.NewServer(grpc.UnaryInterceptor(r.authorize))
+		collectortrace.RegisterTraceServiceServer(r.grpcServer, r)
+		go func() {
+			slog.Info("starting otlp/grpc receiver", "addr", grpcAddress)
+			if err := r.grpcServer.Serve(lis); err != nil {
+				slog.Error("otlp/grpc receiver stopped", "error", err)
+			}
+		}()
+	}
+	go r.sweep()
+	return nil
+}
+
+// stop stops accepting spans and disconnects the exporter. Buffered spans are
+// kept to be exported after a restart.
+func (r *spanReceiver) stop(ctx context.Context) error {
+	if r.grpcServer != nil {
+		r.grpcServer.GracefulStop()
+	}
+	close(r.quit)
+	return r.client.Stop(ctx)
+}
+
+// registerReceiverRoutes adds the OTLP/HTTP endpoint and the traceparent helper
+// to the router, protected by the receiver's bearer token
+func (api *API) registerReceiverRoutes() {
+	group := api.Router.Group("/", requireBearerToken(api.ght.receiver.token))
+	group.POST("/v1/traces", api.receiveTraces)
+	group.GET("/traceparent", api.traceparent)
+}
+
+// receiveTraces handles OTLP/HTTP trace requests in the binary protobuf encoding
+func (api *API) receiveTraces(c *gin.Context) {
+	if c.ContentType() != "application/x-protobuf" {
+		c.String(http.StatusUnsupportedMediaType, "only application/x-protobuf is supported")
+		return
+	}
+	var body io.Reader = http.MaxBytesReader(c.Writer, c.Request.Body, maxReceiveSize)
+	if c.GetHeader("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			c.String(http.StatusBadRequest, "invalid gzip body")
+			return
+		}
+		defer gz.Close()
+		body = io.LimitReader(gz, maxReceiveSize)
+	}
+	raw, err := io.ReadAll(body)
+	if err != nil {
+		c.String(http.StatusBadRequest, "failed to read body")
+		return
+	}
+	req := &collectortrace.ExportTraceServiceRequest{}
+	if err := proto.Unmarshal(raw, req); err != nil {
+		c.String(http.StatusBadRequest, "invalid request")
+		return
+	}
+	err = api.ght.receiver.receive(req.GetResourceSpans())
+	if errors.Is(err, errReceiverFull) {
+		c.String(http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	if err != nil {
+		slog.Error("failed to buffer received spans", "error", err)
+		c.String(http.StatusInternalServerError, "failed to buffer spans")
+		return
+	}
+	resp, _ := proto.Marshal(&collectortrace.ExportTraceServiceResponse{})
+	c.Data(http.StatusOK, "application/x-protobuf", resp)
+}
+
+// Export implements the OTLP/gRPC trace service
+func (r *spanReceiver) Export(_ context.Context, req *collectortrace.ExportTraceServiceRequest) (*collectortrace.ExportTraceServiceResponse, error) {
+	err := r.receive(req.GetResourceSpans())
+	if errors.Is(err, errReceiverFull) {
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+	if err != nil {
+		slog.Error("failed to buffer received spans", "error", err)
+		return nil, status.Error(codes.Internal, "failed to buffer spans")
+	}
+	return &collectortrace.ExportTraceServiceResponse{}, nil
+}
+
+// authorize rejects gRPC requests that do not carry the receiver's bearer token
+func (r *spanReceiver) authorize(ctx context.Context, req any, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	auth := md.Get("authorization")
+	if len(auth) != 1 || subtle.ConstantTimeCompare([]byte(auth[0]), []byte("Bearer "+r.token)) != 1 {
+		return nil, status.Error(codes.Unauthenticated, "invalid token")
+	}
+	return handler(ctx, req)
+}
+
+// receive buffers spans by trace ID
+func (r *spanReceiver) receive(rss []*tracepb.ResourceSpans) error {
+	byTrace := splitByTrace(rss)
+	var n int64
+	for _, batches := range byTrace {
+		for _, rs := range batches {
+			n += int64(countSpans(rs))
+		}
+	}
+	if r.spans.Add(n) > r.maxSpans {
+		r.spans.Add(-n)
+		return errReceiverFull
+	}
+	err := r.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(spansBucket)
+		for traceID, batches := range byTrace {
+			for _, rs := range batches {
+				data, err := proto.Marshal(rs)
+				if err != nil {
+					return err
+				}
+				seq, err := b.NextSequence()
+				if err != nil {
+					return err
+				}
+				header := append(itob(uint64(time.Now().UnixNano())), itob(uint64(countSpans(rs)))...)
+				if err := b.Put(append(traceID[:], itob(seq)...), append(header, data...)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		r.spans.Add(-n)
+	}
+	return err
+}
+
+// splitByTrace splits resource spans into resource spans that each hold the
+// spans of a single trace. Spans with an invalid trace ID are dropped.
+func splitByTrace(rss []*tracepb.ResourceSpans) map[trace.TraceID][]*tracepb.ResourceSpans {
+	byTrace := map[trace.TraceID][]*tracepb.ResourceSpans{}
+	for _, rs := range rss {
+		split := map[trace.TraceID]*tracepb.ResourceSpans{}
+		for _, ss := range rs.GetScopeSpans() {
+			scopes := map[trace.TraceID]*tracepb.ScopeSpans{}
+			for _, span := range ss.GetSpans() {
+				var traceID trace.TraceID
+				if len(span.GetTraceId()) != len(traceID) {
+					continue
+				}
+				copy(traceID[:], span.GetTraceId())
+				if _, ok := split[traceID]; !ok {
+					split[traceID] = &tracepb.ResourceSpans{Resource: rs.GetResource(), SchemaUrl: rs.GetSchemaUrl()}
+				}
+				if _, ok := scopes[traceID]; !ok {
+					scopes[traceID] = &tracepb.ScopeSpans{Scope: ss.GetScope(), SchemaUrl: ss.GetSchemaUrl()}
+					split[traceID].ScopeSpans = append(split[traceID].ScopeSpans, scopes[traceID])
+				}
+				scopes[traceID].Spans = append(scopes[traceID].Spans, span)
+			}
+		}
+		for traceID, traceRS := range split {
+			byTrace[traceID] = append(byTrace[traceID], traceRS)
+		}
+	}
+	return byTrace
+}
+
+// countSpans returns the number of spans in resource spans
+func countSpans(rs *tracepb.ResourceSpans) int {
+	n := 0
+	for _, ss := range rs.GetScopeSpans() {
+		n += len(ss.GetSpans())
+	}
+	return n
+}
+
+// flush exports the spans buffered for a run attempt, re-parented under the
+// spans of the steps that sent them, and removes them from the buffer
+func (r *spanReceiver) flush(ctx context.Context, rt runTrace, jobs []*github.WorkflowJob) error {
+	var keys [][]byte
+	var rss []*tracepb.ResourceSpans
+	var n int64
+	err := r.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(spansBucket).Cursor()
+		prefix := rt.seed[:]
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			rs := &tracepb.ResourceSpans{}
+			if len(v) < 16 {
+				continue
+			}
+			if err := proto.Unmarshal(v[16:], rs); err != nil {
+				return fmt.Errorf("failed to decode buffered spans: %w", err)
+			}
+			keys = append(keys, bytes.Clone(k))
+			rss = append(rss, rs)
+			n += int64(btoi(v[8:16]))
+		}
+		return nil
+	})
+	if err != nil || len(rss) == 0 {
+		return err
+	}
+
+	parents := newStepParents(rt, jobs)
+	for _, rs := range rss {
+		for _, ss := range rs.GetScopeSpans() {
+			for _, span := range ss.GetSpans() {
+				span.TraceId = rt.traceID[:]
+				span.ParentSpanId = parents.resolve(span)
+			}
+		}
+	}
+	if err := r.client.UploadTraces(ctx, rss); err != nil {
+		otlpExportFailures.Inc()
+		return fmt.Errorf("failed to export received spans: %w", err)
+	}
+
+	err = r.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(spansBucket)
+		for _, k := range keys {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to remove exported spans: %w", err)
+	}
+	r.spans.Add(-n)
+	slog.Debug("exported received spans", "trace_id", rt.traceID.String(), "spans", n)
+	return nil
+}
+
+// sweep periodically drops buffered spans that were never claimed by a traced
+// run attempt, e.g. because they were sent with a wrong trace ID
+func (r *spanReceiver) sweep() {
+	ticker := time.NewTicker(sweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.quit:
+			return
+		case <-ticker.C:
+		}
+		cutoff := uint64(time.Now().Add(-r.retention).UnixNano())
+		var dropped int64
+		err := r.db.Update(func(tx *bolt.Tx) error {
+			b := tx.Bucket(spansBucket)
+			var expired [][]byte
+			err := b.ForEach(func(k, v []byte) error {
+				if len(v) >= 16 && btoi(v[:8]) >= cutoff {
+					return nil
+				}
+				if len(v) >= 16 {
+					dropped += int64(btoi(v[8:16]))
+				}
+				expired = append(expired, bytes.Clone(k))
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			for _, k := range expired {
+				if err := b.Delete(k); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			slog.Error("failed to drop expired spans", "error", err)
+			continue
+		}
+		if dropped > 0 {
+			r.spans.Add(-dropped)
+			slog.Warn("dropped received spans that did not belong to a traced run", "spans", dropped)
+		}
+	}
+}
+
+// stepParents resolves the parents of received spans within a run attempt
+type stepParents struct {
+	run   trace.SpanID
+	steps map[trace.SpanID]bool
+	jobs  map[trace.SpanID][]stepParent
+	all   []stepParent
+}
+
+// stepParent is the span of a step and the time it covers
+type stepParent struct {
+	spanID     trace.SpanID
+	start, end time.Time
+}
+
+func newStepParents(rt runTrace, jobs []*github.WorkflowJob) *stepParents {
+	p := &stepParents{
+		run:   rt.spanContext(runSpanKey).SpanID(),
+		steps: map[trace.SpanID]bool{},
+		jobs:  map[trace.SpanID][]stepParent{},
+	}
+	for _, job := range jobs {
+		jobStart, _ := jobTimes(job, time.Now())
+		jobSpanID := rt.spanContext(jobSpanKey(job.GetID())).SpanID()
+		for _, st := range jobStepTimes(job, jobStart) {
+			step := stepParent{
+				spanID: rt.spanContext(stepSpanKey(job.GetID(), st.step.GetNumber())).SpanID(),
+				start:  st.start,
+				end:    st.end,
+			}
+			p.steps[step.spanID] = true
+			p.jobs[jobSpanID] = append(p.jobs[jobSpanID], step)
+			p.all = append(p.all, step)
+		}
+	}
+	return p
+}
+
+// resolve returns the parent span ID of a received span. Spans sent with a
+// step span as their parent, or with a parent of their own, are left as they
+// are. Spans sent with a job span as their parent are moved under the step of
+// that job that was running when they started, and spans sent with the run's
+// root span as their parent under the only step running at that time, if any.
+func (p *stepParents) resolve(span *tracepb.Span) []byte {
+	var parent trace.SpanID
+	copy(parent[:], span.GetParentSpanId())
+	start := time.Unix(0, int64(span.GetStartTimeUnixNano()))
+	var candidates []stepParent
+	switch steps, ok := p.jobs[parent]; {
+	case ok:
+		candidates = steps
+	case parent == p.run:
+		candidates = p.all
+	default:
+		return span.GetParentSpanId()
+	}
+	var match *stepParent
+	for i, step := range candidates {
+		if start.Before(step.start) || start.After(step.end) {
+			continue
+		}
+		if match != nil {
+			return span.GetParentSpanId()
+		}
+		match = &candidates[i]
+	}
+	if match == nil {
+		return span.GetParentSpanId()
+	}
+	return match.spanID[:]
+}
+
+// traceparent returns the W3C traceparent steps set as TRACEPARENT so the
+// spans they send are parented in the CI trace. The parent is the step span
+// if job_id and step are given, the job span if job_id is given or the job can
+// be found by runner name, and the run's root span otherwise.
+func (api *API) traceparent(c *gin.Context) {
+	owner, repo, ok := strings.Cut(c.Query("repository"), "/")
+	runID, err := strconv.ParseInt(c.Query("run_id"), 10, 64)
+	if !ok || err != nil {
+		c.String(http.StatusBadRequest, "repository and run_id are required")
+		return
+	}
+	attempt, err := strconv.Atoi(c.DefaultQuery("run_attempt", "1"))
+	if err != nil {
+		c.String(http.StatusBadRequest, "invalid run_attempt")
+		return
+	}
+	jobID, _ := strconv.ParseInt(c.Query("job_id"), 10, 64)
+	if runner := c.Query("runner"); jobID == 0 && runner != "" {
+		jobID, err = api.ght.runnerJobID(c.Request.Context(), owner, repo, runID, attempt, runner)
+		if err != nil {
+			slog.Warn("failed to find job by runner name", "run_id", runID, "runner", runner, "error", err)
+		}
+	}
+
+	rt := newRunTrace(owner, repo, runID, attempt)
+	key := runSpanKey
+	if jobID != 0 {
+		key = jobSpanKey(jobID)
+		if step, err := strconv.ParseInt(c.Query("step"), 10, 64); err == nil {
+			key = stepSpanKey(jobID, step)
+		}
+	}
+	sc := rt.spanContext(key)
+	c.String(http.StatusOK, "00-%s-%s-%s", sc.TraceID(), sc.SpanID(), sc.TraceFlags())
+}
+
+// runnerJobID returns the ID of the in progress job of a run attempt that runs
+// on the given runner, or 0 if there is none
+func (ght *GitHubTracer) runnerJobID(ctx context.Context, owner, repo string, runID int64, attempt int, runner string) (int64, error) {
+	jobs, _, err := ght.listWorkflowJobs(ctx, owner, repo, runID, attempt)
+	if err != nil {
+		return 0, err
+	}
+	for _, job := range jobs {
+		if job.GetRunnerName() == runner && job.GetStatus() == "in_progress" {
+			return job.GetID(), nil
+		}
+	}
+	return 0, nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/google/go-github/v58/github"
+)
+
+// errLogURLExpired is returned when a job's signed log URL could not be
+// downloaded, typically because it expired before we got to it. Retrying
+// the run retrieves a fresh URL.
+var errLogURLExpired = errors.New("workflow job log url expired")
+
+// errTelemetryFlush is returned when the telemetry of a traced event could not
+// be exported. The collector may be back by the time the event is retried.
+var errTelemetryFlush = errors.New("failed to export telemetry")
+
+// retryPolicy controls how failed workflow runs are retried
+type retryPolicy struct {
+	// maxAttempts is the number of times a run is traced before it is dead-lettered
+	maxAttempts int
+	// baseDelay is the delay before the first retry, doubled on each attempt
+	baseDelay time.Duration
+	// maxDelay caps the delay between two attempts
+	maxDelay time.Duration
+}
+
+// delay returns how long to wait before the next attempt of a run that
+// failed with err on its given attempt. Rate limit errors wait for the
+// limit to reset, all other errors use exponential backoff with jitter.
+func (p retryPolicy) delay(attempt int, err error) time.Duration {
+	var rateErr *github.RateLimitError
+	if errors.As(err, &rateErr) {
+		if d := time.Until(rateErr.Rate.Reset.Time); d > 0 {
+			return d
+		}
+	}
+	var abuseErr *github.AbuseRateLimitError
+	if errors.As(err, &abuseErr) && abuseErr.RetryAfter != nil {
+		return *abuseErr.RetryAfter
+	}
+
+	d := p.baseDelay
+	for i := 1; i < attempt && d < p.maxDelay; i++ {
+		d *= 2
+	}
+	if d > p.maxDelay {
+		d = p.maxDelay
+	}
+	// Use "equal jitter" so retries of runs that failed together spread out
+	// while still waiting at least half of the computed delay
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// isRetryable reports whether a run that failed with err may succeed if
+// it is traced again later.
+func isRetryable(err error) bool {
+	var rateErr *github.RateLimitError
+	var abuseErr *github.AbuseRateLimitError
+	var respErr *github.ErrorResponse
+	var netErr net.Error
+	switch {
+	case errors.Is(err, errLogURLExpired), errors.Is(err, errTelemetryFlush):
+		return true
+	case errors.As(err, &rateErr), errors.As(err, &abuseErr):
+		return true
+	case errors.As(err, &respErr):
+		if respErr.Response == nil {
+			return false
+		}
+		code := respErr.Response.StatusCode
+		return code >= http.StatusInternalServerError || code == http.StatusTooManyRequests
+	case errors.As(err, &netErr):
+		return true
+	}
+	return false
+}
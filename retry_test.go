@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/v58/github"
+)
+
+func TestIsRetryable(t *testing.T) {
+	respErr := func(code int) error {
+		return &github.ErrorResponse{Response: &http.Response{StatusCode: code}}
+	}
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"expired log url", fmt.Errorf("failed to download logs: %w", errLogURLExpired), true},
+		{"telemetry flush", fmt.Errorf("%w: collector unavailable", errTelemetryFlush), true},
+		{"rate limit", &github.RateLimitError{}, true},
+		{"secondary rate limit", &github.AbuseRateLimitError{}, true},
+		{"server error", respErr(http.StatusBadGateway), true},
+		{"too many requests", respErr(http.StatusTooManyRequests), true},
+		{"not found", respErr(http.StatusNotFound), false},
+		{"response error without response", &github.ErrorResponse{}, false},
+		{"network error", fmt.Errorf("failed to get workflow run: %w", &net.OpError{Op: "dial", Err: errors.New("connection refused")}), true},
+		{"other error", errors.New("failed to parse workflow file"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isRetryable(tt.err); got != tt.want {
+				t.Errorf("isRetryable(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	p := retryPolicy{maxAttempts: 5, baseDelay: 10 * time.Second, maxDelay: time.Minute}
+	retryAfter := 42 * time.Second
+	tests := []struct {
+		name     string
+		attempt  int
+		err      error
+		min, max time.Duration
+	}{
+		{"first attempt", 1, errors.New("boom"), 5 * time.Second, 10 * time.Second},
+		{"second attempt", 2, errors.New("boom"), 10 * time.Second, 20 * time.Second},
+		{"third attempt", 3, errors.New("boom"), 20 * time.Second, 40 * time.Second},
+		{"capped at max delay", 10, errors.New("boom"), 30 * time.Second, time.Minute},
+		{
+			"rate limit waits for reset",
+			1,
+			&github.RateLimitError{Rate: github.Rate{Reset: github.Timestamp{Time: time.Now().Add(time.Hour)}}},
+			59 * time.Minute,
+			time.Hour,
+		},
+		{
+			"rate limit already reset",
+			1,
+			&github.RateLimitError{Rate: github.Rate{Reset: github.Timestamp{Time: time.Now().Add(-time.Hour)}}},
+			5 * time.Second,
+			10 * time.Second,
+		},
+		{"secondary rate limit retry after", 1, &github.AbuseRateLimitError{RetryAfter: &retryAfter}, retryAfter, retryAfter},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The delay is jittered, so check it stays within its bounds
+			for i := 0; i < 100; i++ {
+				if got := p.delay(tt.attempt, tt.err); got < tt.min || got > tt.max {
+					t.Fatalf("delay(%d) = %v, want between %v and %v", tt.attempt, got, tt.min, tt.max)
+				}
+			}
+		})
+	}
+}
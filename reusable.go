@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/google/go-github/v58/github"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// workflowCall is a call to a reusable workflow from a job of a run attempt,
+// along with the jobs of the called workflow
+type workflowCall struct {
+	// name is the name of the calling job, including its matrix values
+	name string
+	// path is the called workflow as "<owner>/<repo>/<path>", if known
+	path string
+	// ref is the git ref the called workflow was referenced at, if known
+	ref string
+	// sha is the commit the called workflow ran from, if known
+	sha  string
+	jobs []*github.WorkflowJob
+}
+
+// workflowCalls groups the jobs of a run attempt by the reusable workflow call
+// they were created from. GitHub names these jobs "<caller> / <callee>". When
+// the workflow definition is known, only jobs whose caller uses a reusable
+// workflow are grouped, and the called workflow is resolved from it.
+func workflowCalls(owner, repo string, run *github.WorkflowRun, wd *workflowDefinition, jobs []*github.WorkflowJob) []*workflowCall {
+	var calls []*workflowCall
+	byName := map[string]*workflowCall{}
+	for _, job := range jobs {
+		name, _, ok := strings.Cut(job.GetName(), " / ")
+		if !ok {
+			continue
+		}
+		var uses string
+		if wd != nil {
+			id, ok := wd.jobID(job.GetName())
+			if !ok || wd.Jobs[id].Uses == "" {
+				continue
+			}
+			uses = wd.Jobs[id].Uses
+		}
+		call, ok := byName[name]
+		if !ok {
+			call = &workflowCall{name: name}
+			call.resolve(owner, repo, run, uses)
+			byName[name] = call
+			calls = append(calls, call)
+		}
+		call.jobs = append(call.jobs, job)
+	}
+	return calls
+}
+
+// resolve sets the path, ref and commit of the workflow called with uses.
+// Workflows in the same repository are called by a relative path and run from
+// the same commit as the caller.
+func (c *workflowCall) resolve(owner, repo string, run *github.WorkflowRun, uses string) {
+	if uses == "" {
+		return
+	}
+	path, ref, _ := strings.Cut(uses, "@")
+	if local, ok := strings.CutPrefix(path, "./"); ok {
+		path = fmt.Sprintf("%s/%s/%s", owner, repo, local)
+		c.sha = run.GetHeadSHA()
+	}
+	c.path, c.ref = path, ref
+	for _, rw := range run.ReferencedWorkflows {
+		rwPath, _, _ := strings.Cut(rw.GetPath(), "@")
+		if strings.EqualFold(rwPath, path) {
+			c.sha = rw.GetSHA()
+			if c.ref == "" {
+				c.ref = rw.GetRef()
+			}
+			break
+		}
+	}
+}
+
+// traceWorkflowCall exports the span of a reusable workflow call and returns
+// the context the spans of the called workflow's jobs are started in
+func (ght *GitHubTracer) traceWorkflowCall(parentCtx context.Context, call *workflowCall) context.Context {
+	start, end := groupTimes(call.jobs)
+	failedJobs := countFailed(call.jobs)
+	kvs := []attribute.KeyValue{
+		attribute.String("github.workflow_call.name", call.name),
+		attribute.Int("github.workflow_call.job_count", len(call.jobs)),
+		attribute.Int("github.workflow_call.failed_count", failedJobs),
+	}
+	if call.path != "" {
+		kvs = append(kvs, attribute.String("github.workflow_call.path", call.path))
+	}
+	if call.ref != "" {
+		kvs = append(kvs, attribute.String("github.workflow_call.ref", call.ref))
+	}
+	if call.sha != "" {
+		kvs = append(kvs, attribute.String("github.workflow_call.sha", call.sha))
+	}
+
+	callCtx, callSpan := startSpan(
+		parentCtx,
+		workflowCallSpanKey(call.name),
+		call.name,
+		trace.WithTimestamp(start),
+		trace.WithAttributes(kvs...),
+	)
+	if failedJobs > 0 {
+		callSpan.SetStatus(codes.Error, fmt.Sprintf("%d of %d jobs of the called workflow failed", failedJobs, len(call.jobs)))
+	}
+	// The span's times are already known, so it can be ended before its jobs
+	callSpan.End(trace.WithTimestamp(end))
+	return callCtx
+}
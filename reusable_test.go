@@ -0,0 +1,100 @@
+package main
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/google/go-github/v58/github"
+)
+
+func TestWorkflowCalls(t *testing.T) {
+	workflow := `
+jobs:
+  build:
+    uses: ./.github/workflows/build.yml
+  deploy:
+    uses: octo-org/shared/.github/workflows/deploy.yml@v1
+  release:
+    uses: octo-org/shared/.github/workflows/release.yml
+  "lint / vet":
+    runs-on: ubuntu-latest
+`
+	wd, err := parseWorkflowDefinition([]byte(workflow))
+	if err != nil {
+		t.Fatal(err)
+	}
+	run := &github.WorkflowRun{
+		HeadSHA: github.String("abc123"),
+		ReferencedWorkflows: []*github.ReferencedWorkflow{
+			{
+				Path: github.String("octo-org/shared/.github/workflows/deploy.yml@v1"),
+				SHA:  github.String("def456"),
+				Ref:  github.String("refs/tags/v1"),
+			},
+			{
+				Path: github.String("Octo-Org/Shared/.github/workflows/release.yml@main"),
+				SHA:  github.String("789abc"),
+				Ref:  github.String("refs/heads/main"),
+			},
+		},
+	}
+	job := func(id int64, name string) *github.WorkflowJob {
+		return &github.WorkflowJob{ID: github.Int64(id), Name: github.String(name)}
+	}
+	jobs := []*github.WorkflowJob{
+		job(1, "build / compile"),
+		job(2, "deploy / staging"),
+		job(3, "build / test"),
+		job(4, "lint / vet"),
+		job(5, "release / publish"),
+		job(6, "test"),
+	}
+
+	type call struct {
+		name, path, ref, sha string
+		jobs                 []int64
+	}
+	tests := []struct {
+		name string
+		wd   *workflowDefinition
+		want []call
+	}{
+		{
+			"with definition",
+			wd,
+			[]call{
+				{"build", "octo/repo/.github/workflows/build.yml", "", "abc123", []int64{1, 3}},
+				{"deploy", "octo-org/shared/.github/workflows/deploy.yml", "v1", "def456", []int64{2}},
+				{"release", "octo-org/shared/.github/workflows/release.yml", "refs/heads/main", "789abc", []int64{5}},
+			},
+		},
+		{
+			// Without the definition, any job named like a called job is grouped
+			"without definition",
+			nil,
+			[]call{
+				{"build", "", "", "", []int64{1, 3}},
+				{"deploy", "", "", "", []int64{2}},
+				{"lint", "", "", "", []int64{4}},
+				{"release", "", "", "", []int64{5}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []call
+			for _, c := range workflowCalls("octo", "repo", run, tt.wd, jobs) {
+				var ids []int64
+				for _, job := range c.jobs {
+					ids = append(ids, job.GetID())
+				}
+				got = append(got, call{c.name, c.path, c.ref, c.sha, ids})
+			}
+			if !slices.EqualFunc(got, tt.want, func(a, b call) bool {
+				return a.name == b.name && a.path == b.path && a.ref == b.ref && a.sha == b.sha && slices.Equal(a.jobs, b.jobs)
+			}) {
+				t.Errorf("workflowCalls() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,17 @@
+package main
+
+import (
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// selfTracer traces the exporter's own handling of webhook deliveries, from
+// receipt through the work queue to the GitHub API calls and log uploads made
+// to trace them. It comes from a tracer provider of its own, with a separate
+// service.name, so that these traces never mix with the CI traces they produce.
+// It is a no-op unless self-tracing is enabled.
+var selfTracer trace.Tracer = noop.NewTracerProvider().Tracer("")
+
+// selfPropagator carries the context of a delivery's trace through the work queue
+var selfPropagator = propagation.TraceContext{}
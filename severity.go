@@ -0,0 +1,127 @@
+package main
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+
+	otellog "go.opentelemetry.io/otel/log"
+)
+
+// logLevel is the severity of a line of a job log
+type logLevel string
+
+const (
+	logLevelDebug   logLevel = "debug"
+	logLevelInfo    logLevel = "info"
+	logLevelNotice  logLevel = "notice"
+	logLevelWarning logLevel = "warning"
+	logLevelError   logLevel = "error"
+)
+
+// severity returns the OTLP severity of a level
+func (l logLevel) severity() otellog.Severity {
+	switch l {
+	case logLevelDebug:
+		return otellog.SeverityDebug
+	case logLevelNotice:
+		return otellog.SeverityInfo2
+	case logLevelWarning:
+		return otellog.SeverityWarn
+	case logLevelError:
+		return otellog.SeverityError
+	}
+	return otellog.SeverityInfo
+}
+
+var (
+	// ansiEscape matches the color codes tools write to the log
+	ansiEscape = regexp.MustCompile(`\x1b\[[0-9;]*m`)
+	// runnerCommand matches the prefix the runner writes for annotations and
+	// debug messages, e.g. "##[error]Process completed with exit code 1."
+	runnerCommand = regexp.MustCompile(`^##\[(error|warning|notice|debug)\]`)
+	// workflowCommand matches the workflow commands steps write to create
+	// annotations, e.g. "::error file=app.js,line=1,col=5::Missing semicolon"
+	workflowCommand = regexp.MustCompile(`^::(error|warning|notice|debug)(?:\s+([^:]*))?::`)
+	// compilerMessage matches the "file:line:column: error: message" format of
+	// compilers and linters
+	compilerMessage = regexp.MustCompile(`^([^\s:]+):(\d+)(?::(\d+))?:\s*(?:fatal\s+)?(error|warning)\b`)
+	// toolError and toolWarning match the prefixes common tools use for errors
+	// and warnings, e.g. "error[E0308]:" from rustc, "npm ERR!" or "--- FAIL:"
+	// from go test
+	toolError   = regexp.MustCompile(`^(?:(?i:error|fatal)(?:\[\w+\])?:|npm ERR!|--- FAIL:|FAIL\s)`)
+	toolWarning = regexp.MustCompile(`^(?:(?i:warning)(?:\[\w+\])?:|npm WARN)`)
+	// commandPropertyEscapes undoes the escaping of workflow command properties
+	commandPropertyEscapes = strings.NewReplacer("%25", "%", "%0D", "\r", "%0A", "\n", "%3A", ":", "%2C", ",")
+)
+
+// logAnnotation is the severity of a log line and the source location it refers to, if any
+type logAnnotation struct {
+	level  logLevel
+	file   string
+	line   int
+	column int
+}
+
+// annotateLogLine detects the severity of a log line, given without its
+// timestamp, from the workflow commands and the messages of common tools
+func annotateLogLine(content string) logAnnotation {
+	text := ansiEscape.ReplaceAllString(content, "")
+	if m := runnerCommand.FindStringSubmatch(text); m != nil {
+		return logAnnotation{level: logLevel(m[1])}
+	}
+	if m := workflowCommand.FindStringSubmatch(text); m != nil {
+		a := logAnnotation{level: logLevel(m[1])}
+		for _, property := range strings.Split(m[2], ",") {
+			key, value, _ := strings.Cut(property, "=")
+			value = commandPropertyEscapes.Replace(value)
+			switch strings.TrimSpace(key) {
+			case "file":
+				a.file = value
+			case "line":
+				a.line, _ = strconv.Atoi(value)
+			case "col":
+				a.column, _ = strconv.Atoi(value)
+			}
+		}
+		return a
+	}
+	if m := compilerMessage.FindStringSubmatch(text); m != nil {
+		a := logAnnotation{level: logLevel(m[4]), file: m[1]}
+		a.line, _ = strconv.Atoi(m[2])
+		a.column, _ = strconv.Atoi(m[3])
+		return a
+	}
+	switch {
+	case toolError.MatchString(text):
+		return logAnnotation{level: logLevelError}
+	case toolWarning.MatchString(text):
+		return logAnnotation{level: logLevelWarning}
+	}
+	return logAnnotation{level: logLevelInfo}
+}
+
+// logCounts counts the errors and warnings in the log of each step of a job,
+// by step number
+type logCounts map[int64]*stepLogCount
+
+// stepLogCount counts the errors and warnings in the log of a step
+type stepLogCount struct {
+	errors   int
+	warnings int
+}
+
+// add counts a log line of a step
+func (c logCounts) add(number int64, level logLevel) {
+	count, ok := c[number]
+	if !ok {
+		count = &stepLogCount{}
+		c[number] = count
+	}
+	switch level {
+	case logLevelError:
+		count.errors++
+	case logLevelWarning:
+		count.warnings++
+	}
+}
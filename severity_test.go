@@ -0,0 +1,68 @@
+package main
+
+import "testing"
+
+func TestAnnotateLogLine(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		want logAnnotation
+	}{
+		// Runner prefixes
+		{"runner error", "##[error]Process completed with exit code 1.", logAnnotation{level: logLevelError}},
+		{"runner warning", "##[warning]Node.js 16 actions are deprecated.", logAnnotation{level: logLevelWarning}},
+		{"runner notice", "##[notice]Using cached dependencies", logAnnotation{level: logLevelNotice}},
+		{"runner debug", "##[debug]Evaluating condition for step", logAnnotation{level: logLevelDebug}},
+		// Workflow commands
+		{"workflow command", "::warning::Disk almost full", logAnnotation{level: logLevelWarning}},
+		{
+			"workflow command with properties",
+			"::error file=app.js,line=1,col=5::Missing semicolon",
+			logAnnotation{level: logLevelError, file: "app.js", line: 1, column: 5},
+		},
+		{
+			"workflow command with escaped properties",
+			"::error file=src%2Cold%3Aapp%25.js,line=12::Broken",
+			logAnnotation{level: logLevelError, file: "src,old:app%.js", line: 12},
+		},
+		// Compiler messages
+		{
+			"compiler error",
+			"main.go:10:5: error: undefined: foo",
+			logAnnotation{level: logLevelError, file: "main.go", line: 10, column: 5},
+		},
+		{
+			"compiler fatal error without column",
+			"src/lib.c:42: fatal error: stdio.h: No such file or directory",
+			logAnnotation{level: logLevelError, file: "src/lib.c", line: 42},
+		},
+		{
+			"compiler warning",
+			"app.ts:3:1: warning: unused variable",
+			logAnnotation{level: logLevelWarning, file: "app.ts", line: 3, column: 1},
+		},
+		// Tool errors
+		{"rustc error", "error[E0308]: mismatched types", logAnnotation{level: logLevelError}},
+		{"fatal", "fatal: not a git repository", logAnnotation{level: logLevelError}},
+		{"npm error", "npm ERR! code ELIFECYCLE", logAnnotation{level: logLevelError}},
+		{"go test failure", "--- FAIL: TestFoo (0.00s)", logAnnotation{level: logLevelError}},
+		{"go test package failure", "FAIL\tgithub.com/foo/bar\t0.012s", logAnnotation{level: logLevelError}},
+		{"colored error", "\x1b[31mError:\x1b[0m Cannot find module", logAnnotation{level: logLevelError}},
+		// Tool warnings
+		{"warning", "warning: variable does not need to be mutable", logAnnotation{level: logLevelWarning}},
+		{"rustc warning", "warning[unused_imports]: unused import", logAnnotation{level: logLevelWarning}},
+		{"npm warning", "npm WARN deprecated request@2.88.2", logAnnotation{level: logLevelWarning}},
+		// Lines that merely mention an error
+		{"mentions error", "Retrying after error connecting to registry", logAnnotation{level: logLevelInfo}},
+		{"error count", "0 errors, 0 warnings", logAnnotation{level: logLevelInfo}},
+		{"errors identifier", "errors.New(\"boom\")", logAnnotation{level: logLevelInfo}},
+		{"plain", "Downloading dependencies", logAnnotation{level: logLevelInfo}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := annotateLogLine(tt.line); got != tt.want {
+				t.Errorf("annotateLogLine(%q) = %+v, want %+v", tt.line, got, tt.want)
+			}
+		})
+	}
+}
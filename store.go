@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	// storeFilename is the name of the database file created in the data directory
+	storeFilename = "exporter.db"
+)
+
+var (
+	// queueBucket holds the workflow run events waiting to be traced
+	queueBucket = []byte("queue")
+	// deadLetterBucket holds the workflow run events we gave up on
+	deadLetterBucket = []byte("deadletter")
+	// attemptsBucket records the workflow run attempts that have been traced
+	attemptsBucket = []byte("attempts")
+	// jobsBucket records the workflow jobs exported before their run attempt was traced
+	jobsBucket = []byte("jobs")
+	// spansBucket buffers the spans received from workflow steps until their run is traced
+	spansBucket = []byte("spans")
+)
+
+// openStore opens (or creates) the exporter's embedded database in dataDir
+// and makes sure all buckets we rely on exist.
+func openStore(dataDir string) (*bolt.DB, error) {
+	if err := os.MkdirAll(dataDir, 0o750); err != nil {
+		return nil, fmt.Errorf("failed to create data directory: %w", err)
+	}
+	db, err := bolt.Open(filepath.Join(dataDir, storeFilename), 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open store: %w", err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{queueBucket, deadLetterBucket, attemptsBucket, jobsBucket, spansBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create store buckets: %w", err)
+	}
+	return db, nil
+}
+
+// itob encodes an id as a big endian key so that keys sort in insertion order
+func itob(id uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, id)
+	return b
+}
+
+// btoi decodes a big endian key created with itob
+func btoi(b []byte) uint64 {
+	return binary.BigEndian.Uint64(b)
+}
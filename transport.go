@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// githubAPIHost is the host of the GitHub API. Requests to other hosts, such as
+// the redirects to download logs, are reported as the "external" endpoint.
+const githubAPIHost = "api.github.com"
+
+// instrumentedTransport is an http.RoundTripper that records metrics and self
+// spans for the requests made to the GitHub API
+type instrumentedTransport struct {
+	base http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *instrumentedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	endpoint := githubEndpoint(req)
+	ctx, span := selfTracer.Start(req.Context(), endpoint, trace.WithSpanKind(trace.SpanKindClient))
+	defer span.End()
+	req = req.WithContext(ctx)
+
+	start := time.Now()
+	resp, err := t.base.RoundTrip(req)
+	githubRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds())
+	if err != nil {
+		githubRequests.WithLabelValues(endpoint, "error").Inc()
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return resp, err
+	}
+	githubRequests.WithLabelValues(endpoint, strconv.Itoa(resp.StatusCode)).Inc()
+	span.SetAttributes(attribute.Int("http.status_code", resp.StatusCode))
+	if resp.StatusCode >= http.StatusBadRequest {
+		span.SetStatus(codes.Error, resp.Status)
+	}
+	if remaining, err := strconv.Atoi(resp.Header.Get("X-RateLimit-Remaining")); err == nil {
+		resource := resp.Header.Get("X-RateLimit-Resource")
+		if resource == "" {
+			resource = "core"
+		}
+		githubRateLimitRemaining.WithLabelValues(resource).Set(float64(remaining))
+	}
+	return resp, nil
+}
+
+// githubEndpoint returns the method and route of a request to the GitHub API,
+// with the owner, repository, IDs and file paths replaced by placeholders, e.g.
+// "GET /repos/{owner}/{repo}/actions/runs/{id}/jobs"
+func githubEndpoint(req *http.Request) string {
+	if req.URL.Host != githubAPIHost {
+		return "external"
+	}
+	segments := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+	for i, segment := range segments {
+		switch {
+		case segments[0] == "repos" && i == 1:
+			segments[i] = "{owner}"
+		case segments[0] == "repos" && i == 2:
+			segments[i] = "{repo}"
+		case i > 0 && segments[i-1] == "contents":
+			segments = append(segments[:i], "{path}")
+			return req.Method + " /" + strings.Join(segments, "/")
+		case isNumeric(segment):
+			segments[i] = "{id}"
+		}
+	}
+	return req.Method + " /" + strings.Join(segments, "/")
+}
+
+// isNumeric reports whether s is a non-empty string of digits
+func isNumeric(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
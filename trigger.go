@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/google/go-github/v58/github"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// triggerMode selects how a run triggered by the workflow_run event is
+// connected to the run that triggered it
+type triggerMode string
+
+const (
+	// triggerModeParent exports a triggered run in the trace of the run that
+	// triggered it, under that run's root span
+	triggerModeParent triggerMode = "parent"
+	// triggerModeLink keeps a triggered run in its own trace, with span links
+	// to and from the run that triggered it
+	triggerModeLink triggerMode = "link"
+	// triggerModeNone does not connect triggered runs
+	triggerModeNone triggerMode = "none"
+)
+
+// maxTriggerDepth is the number of workflows GitHub chains with the workflow_run event
+const maxTriggerDepth = 3
+
+// parseTriggerMode validates a trigger mode from the configuration
+func parseTriggerMode(mode string) (triggerMode, error) {
+	switch m := triggerMode(mode); m {
+	case triggerModeParent, triggerModeLink, triggerModeNone:
+		return m, nil
+	}
+	return "", fmt.Errorf("invalid trigger mode %q, must be one of parent, link or none", mode)
+}
+
+// trigger is the run that triggered a workflow run with the workflow_run event
+type trigger struct {
+	run *github.WorkflowRun
+	// spanContext is the root span of the triggering run
+	spanContext trace.SpanContext
+}
+
+// resolveRunTrace returns the trace a run attempt is exported in, along with
+// the run that triggered it if it was triggered by the workflow_run event. wd is
+// the definition of the run's workflow and may be nil.
+func (ght *GitHubTracer) resolveRunTrace(ctx context.Context, owner, repo string, run *github.WorkflowRun, wd *workflowDefinition) (runTrace, *trigger, error) {
+	return ght.resolveRunTraceDepth(ctx, owner, repo, run, wd, 0)
+}
+
+func (ght *GitHubTracer) resolveRunTraceDepth(
+	ctx context.Context,
+	owner,
+	repo string,
+	run *github.WorkflowRun,
+	wd *workflowDefinition,
+	depth int,
+) (runTrace, *trigger, error) {
+	rt := newRunTrace(owner, repo, run.GetID(), run.GetRunAttempt())
+	if ght.triggerMode == triggerModeNone || run.GetEvent() != "workflow_run" || depth >= maxTriggerDepth {
+		return rt, nil, nil
+	}
+	upstream, err := ght.triggeringRun(ctx, owner, repo, run, wd)
+	if err != nil || upstream == nil {
+		return rt, nil, err
+	}
+	upstreamTrace := newRunTrace(owner, repo, upstream.GetID(), upstream.GetRunAttempt())
+	if ght.triggerMode == triggerModeParent {
+		// The triggering run may itself be parented under the run that triggered it
+		var upstreamWD *workflowDefinition
+		if upstream.GetEvent() == "workflow_run" {
+			upstreamWD, err = ght.getWorkflowDefinition(ctx, owner, repo, upstream)
+			if err != nil {
+				slog.Warn("failed to retrieve workflow definition of triggering run", "run_id", upstream.GetID(), "error", err)
+			}
+		}
+		upstreamTrace, _, err = ght.resolveRunTraceDepth(ctx, owner, repo, upstream, upstreamWD, depth+1)
+		if err != nil {
+			return rt, nil, err
+		}
+		rt.traceID = upstreamTrace.traceID
+	}
+	return rt, &trigger{run: upstream, spanContext: upstreamTrace.spanContext(runSpanKey)}, nil
+}
+
+// runTraceEntry is a run attempt resolved for its jobs, cached in
+// GitHubTracer.runTraces until the run attempt itself is traced
+type runTraceEntry struct {
+	rt runTrace
+	tr *trigger
+	// run is the run attempt as it was when its first job completed
+	run *github.WorkflowRun
+	// wd is the definition of the run's workflow, nil if it could not be read
+	wd *workflowDefinition
+	// resolvedAt is used to expire entries of run attempts that never complete
+	resolvedAt time.Time
+}
+
+// jobRunTrace returns the run attempt a workflow job belongs to, along with its
+// workflow definition and trace. They are resolved once for all of its jobs.
+func (ght *GitHubTracer) jobRunTrace(ctx context.Context, owner, repo string, job *github.WorkflowJob) (runTraceEntry, error) {
+	runID, attempt := job.GetRunID(), int(job.GetRunAttempt())
+	key := string(attemptKey(owner, repo, runID, attempt))
+	if entry, ok := ght.runTraces.Load(key); ok {
+		return entry.(runTraceEntry), nil
+	}
+	run, _, err := ght.ghclient.Actions.GetWorkflowRunAttempt(ctx, owner, repo, runID, attempt, nil)
+	if err != nil {
+		return runTraceEntry{}, fmt.Errorf("error retrieving workflow run attempt: %w", err)
+	}
+	wd, err := ght.getWorkflowDefinition(ctx, owner, repo, run)
+	if err != nil {
+		slog.Warn("failed to retrieve workflow definition, the job will be traced without its matrix, dependencies or trigger",
+			"run_id", runID, "job_id", job.GetID(), "error", err)
+	}
+	rt, tr, err := ght.resolveRunTrace(ctx, owner, repo, run, wd)
+	if err != nil {
+		return runTraceEntry{}, fmt.Errorf("error resolving triggering workflow run: %w", err)
+	}
+	entry := runTraceEntry{rt: rt, tr: tr, run: run, wd: wd, resolvedAt: time.Now()}
+	ght.runTraces.Store(key, entry)
+	return entry, nil
+}
+
+// triggeringRun finds the run that triggered a run with the workflow_run event.
+// The event does not identify it, so it is the run of one of the workflows
+// listed under on.workflow_run in the workflow file, for the same commit, that
+// completed last before the triggered run was created. It returns nil if the
+// workflow file is not known or no such run exists.
+func (ght *GitHubTracer) triggeringRun(ctx context.Context, owner, repo string, run *github.WorkflowRun, wd *workflowDefinition) (*github.WorkflowRun, error) {
+	workflows := wd.triggeringWorkflows()
+	if len(workflows) == 0 {
+		slog.Debug("triggering workflows are unknown", "run_id", run.GetID())
+		return nil, nil
+	}
+	workflowIDs, err := ght.getWorkflowIDs(ctx, owner, repo, workflows)
+	if err != nil {
+		return nil, fmt.Errorf("error listing workflows: %w", err)
+	}
+
+	// A triggered run has the head branch and commit of the run that triggered it
+	created := firstTime(time.Now(), run.CreatedAt)
+	opts := &github.ListWorkflowRunsOptions{
+		Status:              "completed",
+		Created:             "<=" + created.UTC().Format(time.RFC3339),
+		ExcludePullRequests: true,
+		ListOptions:         github.ListOptions{PerPage: 20},
+	}
+	if run.HeadSHA != nil {
+		opts.HeadSHA = run.GetHeadSHA()
+	} else {
+		opts.Branch = run.GetHeadBranch()
+	}
+	var upstream *github.WorkflowRun
+	var upstreamTime time.Time
+	for _, workflowID := range workflowIDs {
+		runs, _, err := ght.ghclient.Actions.ListWorkflowRunsByID(ctx, owner, repo, workflowID, opts)
+		if err != nil {
+			return nil, fmt.Errorf("error listing workflow runs: %w", err)
+		}
+		for _, candidate := range runs.WorkflowRuns {
+			if candidate.GetID() == run.GetID() {
+				continue
+			}
+			// Completed runs are last updated when they complete
+			t := firstTime(time.Time{}, candidate.UpdatedAt)
+			if t.IsZero() || t.After(created) {
+				continue
+			}
+			if upstream == nil || t.After(upstreamTime) {
+				upstream, upstreamTime = candidate, t
+			}
+		}
+	}
+	if upstream == nil {
+		slog.Debug("no triggering workflow run found", "run_id", run.GetID(), "workflows", workflows)
+	}
+	return upstream, nil
+}
+
+// getWorkflowIDs returns the IDs of the workflows of a repository with the
+// given names. Names that match no workflow are left out.
+func (ght *GitHubTracer) getWorkflowIDs(ctx context.Context, owner, repo string, names []string) ([]int64, error) {
+	opts := &github.ListOptions{PerPage: 100}
+	var ids []int64
+	for {
+		workflows, resp, err := ght.ghclient.Actions.ListWorkflows(ctx, owner, repo, opts)
+		if err != nil {
+			return nil, err
+		}
+		for _, workflow := range workflows.Workflows {
+			if slices.Contains(names, workflow.GetName()) {
+				ids = append(ids, workflow.GetID())
+			}
+		}
+		if resp.NextPage == 0 {
+			return ids, nil
+		}
+		opts.Page = resp.NextPage
+	}
+}
+
+// links returns the span link from a triggered run to the run that triggered it
+func (tr *trigger) links() []trace.Link {
+	if tr == nil {
+		return nil
+	}
+	return []trace.Link{{
+		SpanContext: tr.spanContext,
+		Attributes: []attribute.KeyValue{
+			attribute.String("github.link.type", "triggered_by"),
+			attribute.Int64("github.run_id", tr.run.GetID()),
+		},
+	}}
+}
+
+// traceTrigger exports a span in the trace of the triggering run that links to
+// the run it triggered, so the chain can be followed from either end. It covers
+// the time between the triggering run completing and the triggered run being created.
+func (ght *GitHubTracer) traceTrigger(run *github.WorkflowRun, rt runTrace, tr *trigger) {
+	start := firstTime(time.Now(), tr.run.UpdatedAt)
+	start, end := spanTimes(start, firstTime(start, run.CreatedAt))
+	_, span := startSpan(
+		trace.ContextWithRemoteSpanContext(context.Background(), tr.spanContext),
+		triggerSpanKey(run.GetID(), run.GetRunAttempt()),
+		fmt.Sprintf("trigger %s", run.GetName()),
+		trace.WithTimestamp(start),
+		trace.WithLinks(trace.Link{
+			SpanContext: rt.spanContext(runSpanKey),
+			Attributes: []attribute.KeyValue{
+				attribute.String("github.link.type", "triggered"),
+				attribute.Int64("github.run_id", run.GetID()),
+			},
+		}),
+		trace.WithAttributes(
+			attribute.Int64("github.triggered.run_id", run.GetID()),
+			attribute.Int("github.triggered.run_attempt", run.GetRunAttempt()),
+			attribute.String("github.triggered.workflow_name", run.GetName()),
+			attribute.String("github.triggered.html_url", run.GetHTMLURL()),
+		),
+	)
+	span.End(trace.WithTimestamp(end))
+}
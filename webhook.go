@@ -2,62 +2,130 @@ package main
 
 import (
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
 	"os"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/go-github/v58/github"
-	"github.com/grafana/loki-client-go/loki"
-	"github.com/grafana/loki-client-go/pkg/urlutil"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
-	"github.com/prometheus/common/config"
 	sloggin "github.com/samber/slog-gin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	otellog "go.opentelemetry.io/otel/log"
+	"go.opentelemetry.io/otel/log/global"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // API is the main API struct
 type API struct {
-	ctx    context.Context
-	Router *gin.Engine
-	ght    *GitHubTracer
+	ctx            context.Context
+	Router         *gin.Engine
+	ght            *GitHubTracer
+	webhookSecrets [][]byte
 }
 
 // NewAPI creates a new API instance
-func NewAPI(ctx context.Context, ghclient *github.Client, logEndpoint, logAuthHeader string) (*API, error) {
-	var lokiClient *loki.Client
-	if logEndpoint != "" {
+func NewAPI(ctx context.Context, ghclient *github.Client, conf Config, flush func(context.Context) error) (*API, error) {
+	attrMode, err := parseAttributeMode(conf.AttributeMode)
+	if err != nil {
+		return nil, err
+	}
+	triggerMode, err := parseTriggerMode(conf.TriggerMode)
+	if err != nil {
+		return nil, err
+	}
+	metrics, err := newCIMetrics(otel.Meter("github.actions"), conf.MetricDimensions)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create ci metrics: %w", err)
+	}
+
+	logExporter, err := parseLogExporter(conf.LogExporter)
+	if err != nil {
+		return nil, err
+	}
+	var otlpLogger otellog.Logger
+	if logExporter.otlp() {
+		slog.Info("enabling otlp exporter for logs")
+		otlpLogger = global.Logger("github.actions")
+	}
+
+	var pusher *lokiPusher
+	if logEndpoint := conf.LogEndpoint; logExporter.loki() && logEndpoint != "" {
 		slog.Info("enabling loki client for log")
-		var u urlutil.URLValue
-		u.Set(logEndpoint)
-		lokiConf, err := loki.NewDefaultConfig(logEndpoint)
-		if err != nil {
-			return nil, fmt.Errorf("failed to create loki config: %w", err)
-		}
-		if logAuthHeader != "" {
+		if conf.LogAuthHeader != "" {
 			slog.Info("using authenicated loki client")
-			lokiConf.Client.Authorization = &config.Authorization{
-				Credentials: config.Secret(logAuthHeader),
-			}
 		}
-		lokiClient, err = loki.New(lokiConf)
+		pusher, err = newLokiPusher(logEndpoint, conf.LogAuthHeader, conf.LogLabels)
 		if err != nil {
 			return nil, fmt.Errorf("failed to create loki client: %w", err)
 		}
 	}
 
+	// Open the store backing the work queue
+	db, err := openStore(conf.DataDir)
+	if err != nil {
+		return nil, err
+	}
+	queue, err := newWorkQueue(db, conf.QueueSize)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to load work queue: %w", err)
+	}
+
+	var receiver *spanReceiver
+	if conf.ReceiverEnabled {
+		slog.Info("enabling otlp receiver for spans sent by workflow steps")
+		receiver, err = newSpanReceiver(db, conf)
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+
 	ght := &GitHubTracer{
-		ctx:        ctx,
-		ghclient:   ghclient,
-		lokiClient: lokiClient,
-		queue:      make(chan github.WorkflowRunEvent),
-		quit:       make(chan struct{}),
+		ctx:      ctx,
+		ghclient: ghclient,
+		loki:     pusher,
+		logger:   otlpLogger,
+		db:       db,
+		queue:    queue,
+		retry: retryPolicy{
+			maxAttempts: conf.MaxAttempts,
+			baseDelay:   conf.RetryBaseDelay,
+			maxDelay:    conf.RetryMaxDelay,
+		},
+		attrMode:    attrMode,
+		triggerMode: triggerMode,
+		metrics:     metrics,
+		receiver:    receiver,
+		logMaxBytes: conf.LogMaxBytes,
+		flush:       flush,
+		retention:   conf.StateRetention,
+		quit:        make(chan struct{}),
+		done:        make(chan struct{}),
 	}
 	api := API{
 		ctx:    ctx,
 		Router: gin.New(),
 		ght:    ght,
 	}
+	for _, secret := range conf.WebhookSecrets {
+		if secret != "" {
+			api.webhookSecrets = append(api.webhookSecrets, []byte(secret))
+		}
+	}
+	if len(api.webhookSecrets) == 0 {
+		slog.Warn("no webhook secrets configured and WEBHOOK_INSECURE is set, webhook signatures will not be verified")
+	}
 	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
 	api.Router.Use(
 		sloggin.NewWithFilters(
@@ -70,6 +138,12 @@ func NewAPI(ctx context.Context, ghclient *github.Client, logEndpoint, logAuthHe
 	// Load proxy paths
 	api.Router.POST("/webhook", api.handleWebhook)
 	api.Router.GET("/metrics", gin.WrapH(promhttp.Handler()))
+	if conf.AdminToken != "" {
+		api.registerAdminRoutes(conf.AdminToken)
+	}
+	if receiver != nil {
+		api.registerReceiverRoutes()
+	}
 
 	// If running on k8s, add liveness and readiness endpoints
 	api.Router.GET("/liveness", func(c *gin.Context) { c.String(http.StatusOK, "ok") })
@@ -79,46 +153,163 @@ func NewAPI(ctx context.Context, ghclient *github.Client, logEndpoint, logAuthHe
 
 func (api *API) Shutdown() error {
 	slog.Info("shutting down api client")
-	if api.ght.lokiClient != nil {
-		slog.Info("shutting down loki client")
-		api.ght.lokiClient.Stop()
-	}
+	// Wait for the tracer to finish before closing the clients it uses
 	close(api.ght.quit)
+	<-api.ght.done
+	if api.ght.receiver != nil {
+		slog.Info("shutting down otlp receiver")
+		ctx, cancel := context.WithTimeout(context.Background(), httpShutdownTimeout)
+		defer cancel()
+		if err := api.ght.receiver.stop(ctx); err != nil {
+			slog.Error("failed to stop otlp receiver", "error", err)
+		}
+	}
+	if err := api.ght.db.Close(); err != nil {
+		return fmt.Errorf("failed to close store: %w", err)
+	}
 	return nil
 }
 
-// Handle webhook handles the github.WorkflowRunEvent webhook
-// and executes the traceWorkflowRun function
+// Handle webhook handles the github.WorkflowRunEvent and github.WorkflowJobEvent
+// webhooks and queues them to be traced
 func (api *API) handleWebhook(c *gin.Context) {
-	payload := github.WorkflowRunEvent{}
-	err := c.BindJSON(&payload)
+	event := webhookEvent(c.GetHeader("X-GitHub-Event"))
+	webhooksReceived.WithLabelValues(event).Inc()
+
+	ctx, span := selfTracer.Start(c.Request.Context(), "webhook "+event,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("github.event", c.GetHeader("X-GitHub-Event")),
+			attribute.String("github.delivery", c.GetHeader("X-GitHub-Delivery")),
+		))
+	defer func() {
+		span.SetAttributes(attribute.Int("http.status_code", c.Writer.Status()))
+		span.End()
+	}()
+
+	body, err := c.GetRawData()
 	if err != nil {
-		slog.Debug("failed to unmarshal github.WorkflowRunEvent", "error", err)
+		slog.Debug("failed to read webhook body", "error", err)
+		webhooksRejected.WithLabelValues(event, "bad_payload").Inc()
 		c.String(http.StatusBadRequest, "bad payload")
 		return
 	}
 
+	// Reject deliveries that were not signed with one of our secrets
+	if len(api.webhookSecrets) > 0 && !validSignature(c.GetHeader("X-Hub-Signature-256"), body, api.webhookSecrets) {
+		slog.Warn("rejecting webhook with invalid signature", "delivery", c.GetHeader("X-GitHub-Delivery"))
+		webhooksRejected.WithLabelValues(event, "invalid_signature").Inc()
+		c.String(http.StatusUnauthorized, "invalid signature")
+		return
+	}
+
 	// If this is a ping event, return ok
 	if c.GetHeader("X-GitHub-Event") == "ping" {
 		c.String(http.StatusOK, "ok")
 		return
 	}
 
-	// If the payload did not bind a workflow run, return bad request
-	if payload.WorkflowRun == nil {
-		slog.Debug("payload does not contain workflow run")
+	// Decode the event into a queue item
+	var item *queueItem
+	switch c.GetHeader("X-GitHub-Event") {
+	case "workflow_job":
+		item, err = decodeWorkflowJobEvent(body)
+	default:
+		item, err = decodeWorkflowRunEvent(body)
+	}
+	if err != nil {
+		slog.Debug("failed to decode webhook", "error", err)
+		webhooksRejected.WithLabelValues(event, "bad_payload").Inc()
 		c.String(http.StatusBadRequest, "bad payload")
+		return
 	}
 
-	// Don't trace workflows that are not completed
-	if *payload.WorkflowRun.Status != "completed" {
-		slog.Debug("workflow run not completed", "status", payload.WorkflowRun.Status)
+	// Nothing to trace until the run or job is completed
+	if item == nil {
 		c.String(http.StatusOK, "ok")
 		return
 	}
 
-	// Queue the workflow to be traced
-	api.ght.queue <- payload
+	// Carry the delivery's trace through the queue to the worker tracing it
+	item.TraceContext = map[string]string{}
+	selfPropagator.Inject(ctx, propagation.MapCarrier(item.TraceContext))
+
+	// Persist the event to be traced before acknowledging the delivery
+	if err := api.ght.queue.push(item); err != nil {
+		if errors.Is(err, errQueueFull) {
+			slog.Warn("work queue is full, rejecting workflow event", "run_id", item.runID())
+			webhooksRejected.WithLabelValues(event, "queue_full").Inc()
+			c.String(http.StatusServiceUnavailable, "queue full")
+			return
+		}
+		slog.Error("failed to queue workflow event", "error", err)
+		c.String(http.StatusInternalServerError, "failed to queue workflow event")
+		return
+	}
 
 	c.String(http.StatusOK, "ok")
 }
+
+// decodeWorkflowRunEvent decodes a github.WorkflowRunEvent webhook. It returns
+// a nil item if the run is not completed yet.
+func decodeWorkflowRunEvent(body []byte) (*queueItem, error) {
+	payload := github.WorkflowRunEvent{}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal github.WorkflowRunEvent: %w", err)
+	}
+
+	// If the payload did not bind a workflow run, return bad request
+	if payload.WorkflowRun == nil {
+		return nil, errors.New("payload does not contain workflow run")
+	}
+
+	// Don't trace workflows that are not completed
+	if payload.WorkflowRun.GetStatus() != "completed" {
+		slog.Debug("workflow run not completed", "status", payload.WorkflowRun.GetStatus())
+		return nil, nil
+	}
+	return &queueItem{Run: &payload}, nil
+}
+
+// decodeWorkflowJobEvent decodes a github.WorkflowJobEvent webhook. Queued and
+// in progress jobs are acknowledged but only completed jobs are traced, in
+// which case a nil item is returned.
+func decodeWorkflowJobEvent(body []byte) (*queueItem, error) {
+	payload := github.WorkflowJobEvent{}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal github.WorkflowJobEvent: %w", err)
+	}
+
+	// If the payload did not bind a workflow job, return bad request
+	if payload.WorkflowJob == nil {
+		return nil, errors.New("payload does not contain workflow job")
+	}
+
+	// Don't trace jobs that are not completed
+	if payload.WorkflowJob.GetStatus() != "completed" {
+		slog.Debug("workflow job not completed", "action", payload.GetAction(), "status", payload.WorkflowJob.GetStatus())
+		return nil, nil
+	}
+	return &queueItem{Job: &payload}, nil
+}
+
+// validSignature reports whether signature is a valid X-Hub-Signature-256 value
+// for body under any of the given secrets. Comparisons are done in constant time.
+func validSignature(signature string, body []byte, secrets [][]byte) bool {
+	digest, ok := strings.CutPrefix(signature, "sha256=")
+	if !ok {
+		return false
+	}
+	expected, err := hex.DecodeString(digest)
+	if err != nil {
+		return false
+	}
+	for _, secret := range secrets {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(body)
+		if hmac.Equal(mac.Sum(nil), expected) {
+			return true
+		}
+	}
+	return false
+}
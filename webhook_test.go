@@ -0,0 +1,68 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// sign returns the X-Hub-Signature-256 header GitHub sends for body
+func sign(secret, body string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(body))
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestValidSignature(t *testing.T) {
+	body := `{"action":"completed"}`
+	secrets := [][]byte{[]byte("current"), []byte("previous")}
+
+	tests := []struct {
+		name      string
+		signature string
+		want      bool
+	}{
+		{"valid secret", sign("current", body), true},
+		{"rotated second secret", sign("previous", body), true},
+		{"missing prefix", strings.TrimPrefix(sign("current", body), "sha256="), false},
+		{"non-hex digest", "sha256=not-hex", false},
+		{"wrong digest", sign("other", body), false},
+		{"signature of another body", sign("current", `{"action":"requested"}`), false},
+		{"empty", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := validSignature(tt.signature, []byte(body), secrets); got != tt.want {
+				t.Errorf("validSignature() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandleWebhookRejectsUnsignedDelivery(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	api := &API{Router: gin.New(), webhookSecrets: [][]byte{[]byte("current")}}
+	api.Router.POST("/webhook", api.handleWebhook)
+
+	rejected := webhooksRejected.WithLabelValues("workflow_run", "invalid_signature")
+	before := testutil.ToFloat64(rejected)
+
+	req := httptest.NewRequest(http.MethodPost, "/webhook", strings.NewReader(`{"action":"completed"}`))
+	req.Header.Set("X-GitHub-Event", "workflow_run")
+	rec := httptest.NewRecorder()
+	api.Router.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+	if got := testutil.ToFloat64(rejected) - before; got != 1 {
+		t.Errorf("webhooks_rejected_total{reason=\"invalid_signature\"} increased by %v, want 1", got)
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/google/go-github/v58/github"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"gopkg.in/yaml.v3"
+)
+
+// workflowDefinition is the subset of a workflow file used to model a run
+type workflowDefinition struct {
+	// On is kept as a node since it can be a string, a list or a mapping
+	On   yaml.Node                         `yaml:"on"`
+	Jobs map[string]*workflowJobDefinition `yaml:"jobs"`
+}
+
+// triggeringWorkflows returns the names of the workflows whose runs trigger
+// this workflow with the workflow_run event
+func (wd *workflowDefinition) triggeringWorkflows() []string {
+	if wd == nil || wd.On.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(wd.On.Content); i += 2 {
+		if wd.On.Content[i].Value != "workflow_run" {
+			continue
+		}
+		var trigger struct {
+			Workflows stringList `yaml:"workflows"`
+		}
+		if err := wd.On.Content[i+1].Decode(&trigger); err != nil {
+			return nil
+		}
+		return trigger.Workflows
+	}
+	return nil
+}
+
+// workflowJobDefinition is a job as defined in a workflow file
+type workflowJobDefinition struct {
+	Name  string     `yaml:"name"`
+	Needs stringList `yaml:"needs"`
+	Uses  string     `yaml:"uses"`
+
+	Strategy struct {
+		// Matrix is kept as a node to preserve the order of its dimensions
+		Matrix yaml.Node `yaml:"matrix"`
+	} `yaml:"strategy"`
+
+	// namePattern matches the names of the jobs created from this definition
+	// when its name contains expressions
+	namePattern *regexp.Regexp
+}
+
+// stringList is a YAML value that is either a single string or a list of strings
+type stringList []string
+
+// UnmarshalYAML implements yaml.Unmarshaler
+func (l *stringList) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*l = stringList{value.Value}
+		return nil
+	}
+	var list []string
+	if err := value.Decode(&list); err != nil {
+		return err
+	}
+	*l = list
+	return nil
+}
+
+// expressionPattern matches ${{ }} expressions in a workflow file
+var expressionPattern = regexp.MustCompile(`\$\{\{.*?\}\}`)
+
+// parseWorkflowDefinition parses the contents of a workflow file
+func parseWorkflowDefinition(content []byte) (*workflowDefinition, error) {
+	wd := &workflowDefinition{}
+	if err := yaml.Unmarshal(content, wd); err != nil {
+		return nil, fmt.Errorf("failed to parse workflow file: %w", err)
+	}
+	for _, def := range wd.Jobs {
+		if def == nil || !expressionPattern.MatchString(def.Name) {
+			continue
+		}
+		// Expressions are evaluated by GitHub, so match them against anything
+		parts := expressionPattern.Split(def.Name, -1)
+		for i, part := range parts {
+			parts[i] = regexp.QuoteMeta(part)
+		}
+		def.namePattern = regexp.MustCompile("^" + strings.Join(parts, ".*") + "$")
+	}
+	return wd, nil
+}
+
+// matrixSuffix matches the matrix values GitHub appends to the names of jobs
+// created from a matrix, e.g. "test (ubuntu-latest, 1.21)"
+var matrixSuffix = regexp.MustCompile(`^(.*) \((.*)\)$`)
+
+// jobID returns the ID of the job definition a workflow job was created from
+func (wd *workflowDefinition) jobID(name string) (string, bool) {
+	if wd == nil {
+		return "", false
+	}
+	// Jobs from reusable workflows are named "<caller> / <callee>"
+	name, _, _ = strings.Cut(name, " / ")
+	candidates := []string{name}
+	if m := matrixSuffix.FindStringSubmatch(name); m != nil {
+		candidates = append(candidates, m[1])
+	}
+	for _, candidate := range candidates {
+		for id, def := range wd.Jobs {
+			if def == nil {
+				continue
+			}
+			if candidate == id && def.Name == "" || candidate == def.Name {
+				return id, true
+			}
+			if def.namePattern != nil && def.namePattern.MatchString(candidate) {
+				return id, true
+			}
+		}
+	}
+	return "", false
+}
+
+// getWorkflowDefinition retrieves and parses the workflow file of a run at the
+// commit it ran on
+func (ght *GitHubTracer) getWorkflowDefinition(ctx context.Context, owner, repo string, run *github.WorkflowRun) (*workflowDefinition, error) {
+	path, err := ght.getWorkflowPath(ctx, owner, repo, run.GetWorkflowID())
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving workflow: %w", err)
+	}
+	file, _, _, err := ght.ghclient.Repositories.GetContents(ctx, owner, repo, path, &github.RepositoryContentGetOptions{
+		Ref: run.GetHeadSHA(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving workflow file: %w", err)
+	}
+	if file == nil {
+		return nil, fmt.Errorf("workflow file %s is not a file", path)
+	}
+	content, err := file.GetContent()
+	if err != nil {
+		return nil, fmt.Errorf("error decoding workflow file: %w", err)
+	}
+	return parseWorkflowDefinition([]byte(content))
+}
+
+// getWorkflowPath returns the path of a workflow's file. Paths are cached since
+// they do not change for a given workflow.
+func (ght *GitHubTracer) getWorkflowPath(ctx context.Context, owner, repo string, workflowID int64) (string, error) {
+	key := fmt.Sprintf("%s/%s/%d", owner, repo, workflowID)
+	if path, ok := ght.workflowPaths.Load(key); ok {
+		return path.(string), nil
+	}
+	workflow, _, err := ght.ghclient.Actions.GetWorkflowByID(ctx, owner, repo, workflowID)
+	if err != nil {
+		return "", err
+	}
+	ght.workflowPaths.Store(key, workflow.GetPath())
+	return workflow.GetPath(), nil
+}
+
+// jobGraph holds the dependencies between the jobs of a run attempt, as
+// declared with needs in the workflow file, and the run's critical path.
+type jobGraph struct {
+	// needs maps a job ID to the IDs of the jobs it depends on
+	needs map[int64][]int64
+	// critical holds the jobs on the critical path
+	critical map[int64]bool
+	// criticalPath is the names of the jobs on the critical path, in order
+	criticalPath []string
+	// criticalDuration is the total duration of the jobs on the critical path,
+	// including the time they waited for a runner
+	criticalDuration time.Duration
+}
+
+// newJobGraph builds the dependency graph of a run attempt's jobs. If the
+// workflow definition is nil, the graph has no dependencies.
+func newJobGraph(wd *workflowDefinition, jobs []*github.WorkflowJob) *jobGraph {
+	g := &jobGraph{
+		needs:    map[int64][]int64{},
+		critical: map[int64]bool{},
+	}
+	if wd == nil {
+		return g
+	}
+
+	// Group the jobs by the definition they were created from
+	defs := map[int64]string{}
+	byDef := map[string][]*github.WorkflowJob{}
+	for _, job := range jobs {
+		if id, ok := wd.jobID(job.GetName()); ok {
+			defs[job.GetID()] = id
+			byDef[id] = append(byDef[id], job)
+		}
+	}
+	byID := map[int64]*github.WorkflowJob{}
+	for _, job := range jobs {
+		byID[job.GetID()] = job
+		for _, need := range wd.Jobs[defs[job.GetID()]].neededJobs() {
+			for _, dep := range byDef[need] {
+				g.needs[job.GetID()] = append(g.needs[job.GetID()], dep.GetID())
+			}
+		}
+	}
+
+	// The critical path ends with the last job to complete, and goes back
+	// through the dependency that completed last at each step
+	var last *github.WorkflowJob
+	for _, job := range jobs {
+		if last == nil || jobEnd(job).After(jobEnd(last)) {
+			last = job
+		}
+	}
+	for job := last; job != nil && !g.critical[job.GetID()]; {
+		g.critical[job.GetID()] = true
+		g.criticalPath = append([]string{job.GetName()}, g.criticalPath...)
+		start, end := jobTimes(job, time.Time{})
+		g.criticalDuration += end.Sub(firstTime(start, job.CreatedAt))
+
+		var next *github.WorkflowJob
+		for _, dep := range g.needs[job.GetID()] {
+			if next == nil || jobEnd(byID[dep]).After(jobEnd(next)) {
+				next = byID[dep]
+			}
+		}
+		job = next
+	}
+	return g
+}
+
+// neededJobs returns the IDs of the jobs a definition depends on
+func (def *workflowJobDefinition) neededJobs() []string {
+	if def == nil {
+		return nil
+	}
+	return def.Needs
+}
+
+// jobEnd returns the time a workflow job completed
+func jobEnd(job *github.WorkflowJob) time.Time {
+	_, end := jobTimes(job, time.Time{})
+	return end
+}
+
+// links returns span links from a job to the spans of the jobs it depends on
+func (g *jobGraph) links(rt runTrace, jobID int64) []trace.Link {
+	var links []trace.Link
+	for _, dep := range g.needs[jobID] {
+		links = append(links, trace.Link{
+			SpanContext: rt.spanContext(jobSpanKey(dep)),
+			Attributes: []attribute.KeyValue{
+				attribute.String("github.link.type", "needs"),
+			},
+		})
+	}
+	return links
+}
+
+// runAttributes returns the critical path attributes of a run's root span
+func (g *jobGraph) runAttributes() []attribute.KeyValue {
+	if len(g.criticalPath) == 0 {
+		return nil
+	}
+	return []attribute.KeyValue{
+		attribute.StringSlice("github.critical_path.jobs", g.criticalPath),
+		attribute.Int64("github.critical_path.duration_ms", g.criticalDuration.Milliseconds()),
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"maps"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/v58/github"
+)
+
+func TestNewJobGraph(t *testing.T) {
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	at := func(minutes int) *github.Timestamp {
+		return &github.Timestamp{Time: base.Add(time.Duration(minutes) * time.Minute)}
+	}
+	// job returns a job created at created, started a minute later and
+	// completed at completed, in minutes after base
+	job := func(id int64, name string, created, completed int) *github.WorkflowJob {
+		return &github.WorkflowJob{
+			ID:          github.Int64(id),
+			Name:        github.String(name),
+			CreatedAt:   at(created),
+			StartedAt:   at(created + 1),
+			CompletedAt: at(completed),
+		}
+	}
+	workflow := `
+jobs:
+  build: {}
+  lint: {}
+  test:
+    needs: build
+    strategy:
+      matrix:
+        os: [linux, windows]
+  deploy:
+    needs: [test, lint]
+    uses: ./.github/workflows/deploy.yml
+`
+	wd, err := parseWorkflowDefinition([]byte(workflow))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name         string
+		wd           *workflowDefinition
+		jobs         []*github.WorkflowJob
+		wantNeeds    map[int64][]int64
+		wantPath     []string
+		wantDuration time.Duration
+	}{
+		{
+			"no jobs",
+			wd,
+			nil,
+			map[int64][]int64{},
+			nil,
+			0,
+		},
+		{
+			"without definition",
+			nil,
+			[]*github.WorkflowJob{job(1, "build", 0, 5), job(2, "test (linux)", 5, 10)},
+			map[int64][]int64{},
+			nil,
+			0,
+		},
+		{
+			"single job",
+			wd,
+			[]*github.WorkflowJob{job(1, "build", 0, 5)},
+			map[int64][]int64{},
+			[]string{"build"},
+			5 * time.Minute,
+		},
+		{
+			"matrix and reusable workflow",
+			wd,
+			[]*github.WorkflowJob{
+				job(1, "build", 0, 5),
+				job(2, "lint", 0, 3),
+				job(3, "test (linux)", 5, 10),
+				job(4, "test (windows)", 6, 15),
+				job(5, "deploy / release", 15, 20),
+			},
+			map[int64][]int64{3: {1}, 4: {1}, 5: {3, 4, 2}},
+			[]string{"build", "test (windows)", "deploy / release"},
+			19 * time.Minute,
+		},
+		{
+			"dependency completing first is not critical",
+			wd,
+			[]*github.WorkflowJob{
+				job(1, "build", 0, 2),
+				job(2, "lint", 0, 12),
+				job(3, "test (linux)", 2, 10),
+				job(5, "deploy / release", 12, 14),
+			},
+			map[int64][]int64{3: {1}, 5: {3, 2}},
+			[]string{"lint", "deploy / release"},
+			14 * time.Minute,
+		},
+		{
+			"last job without dependencies",
+			wd,
+			[]*github.WorkflowJob{
+				job(1, "build", 0, 5),
+				job(3, "test (linux)", 5, 10),
+				job(2, "lint", 0, 30),
+			},
+			map[int64][]int64{3: {1}},
+			[]string{"lint"},
+			30 * time.Minute,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := newJobGraph(tt.wd, tt.jobs)
+			if !maps.EqualFunc(g.needs, tt.wantNeeds, slices.Equal) {
+				t.Errorf("needs = %v, want %v", g.needs, tt.wantNeeds)
+			}
+			if !slices.Equal(g.criticalPath, tt.wantPath) {
+				t.Errorf("criticalPath = %q, want %q", g.criticalPath, tt.wantPath)
+			}
+			if g.criticalDuration != tt.wantDuration {
+				t.Errorf("criticalDuration = %v, want %v", g.criticalDuration, tt.wantDuration)
+			}
+			for _, job := range tt.jobs {
+				if want := slices.Contains(tt.wantPath, job.GetName()); g.critical[job.GetID()] != want {
+					t.Errorf("critical[%d] = %v, want %v", job.GetID(), g.critical[job.GetID()], want)
+				}
+			}
+		})
+	}
+}